@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"github.com/fara/fakeauto/internal/data"
+	"github.com/fara/fakeauto/internal/validator"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The listUsersHandler() lists users for administrators, with optional search terms
+// for the email address and name, and a filter on whether the user is activated, e.g.
+// ?email=example.com&activated=false&sort=-created_at
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		data.UserSearch
+		data.Filters
+	}
+	v := validator.New()
+	qs := r.URL.Query()
+	input.UserSearch.Email = app.readString(qs, "email", "")
+	input.UserSearch.Name = app.readString(qs, "name", "")
+	if activated := qs.Get("activated"); activated != "" {
+		value, err := strconv.ParseBool(activated)
+		if err != nil {
+			v.AddError("activated", "must be a boolean value")
+		}
+		input.UserSearch.Activated = &value
+	}
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafelist = data.UserSortSafelist
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	users, metadata, err := app.models.Users.GetAll(input.UserSearch, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readUserParam() helper reads the id parameter and looks up the user it names,
+// sending a 404 Not Found response and returning nil if there is no such user.
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) *data.User {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+	user, err := app.models.Users.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return user
+}
+
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+	err := app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deactivateUserHandler() deactivates a user's account and revokes all of their
+// tokens, signing them out everywhere. Their API keys are kept, so they work again if
+// the user is reactivated, but authenticate() rejects them while the user is
+// deactivated. Signed authentication tokens can't be revoked, so in JWT mode the user
+// keeps access until their current token expires.
+func (app *application) deactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	app.setUserDeactivated(w, r, true)
+}
+
+// The reactivateUserHandler() lifts the deactivation of a user's account. It doesn't
+// activate the account, so a user whose email address hasn't been verified still has
+// to do so.
+func (app *application) reactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	app.setUserDeactivated(w, r, false)
+}
+
+func (app *application) setUserDeactivated(w http.ResponseWriter, r *http.Request, deactivated bool) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+	if deactivated && user.ID == app.contextGetUser(r).ID {
+		v := validator.New()
+		v.AddError("id", "you cannot deactivate your own account")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	if !deactivated && user.DeactivatedAt == nil {
+		v := validator.New()
+		v.AddError("id", "the user's account is not deactivated")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err := app.models.Users.SetDeactivated(user.ID, deactivated)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if deactivated {
+		err = app.models.Tokens.DeleteEverythingForUser(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	// Read the user back to send their new state to the client.
+	user = app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The forceUserPasswordResetHandler() makes a user choose a new password: their current
+// password is replaced with a random one nobody knows, all of their tokens are revoked,
+// and they are emailed a password reset token.
+func (app *application) forceUserPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = user.Password.Set(base64.RawURLEncoding.EncodeToString(randomBytes))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.models.Tokens.DeleteEverythingForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.background(func() {
+		data := map[string]any{
+			"passwordResetToken": token.Plaintext,
+		}
+		err := app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+	env := envelope{"message": "the user's password has been reset and an email will be sent to them containing password reset instructions"}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	if id == app.contextGetUser(r).ID {
+		v := validator.New()
+		v.AddError("id", "you cannot delete your own account here, use DELETE /v1/users/me")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Users.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"github.com/fara/fakeauto/internal/data"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A permissionCache holds the permissions of recently seen users in memory, so that
+// requirePermission() doesn't have to query the database on every request. An entry is
+// never used once ttl has passed since it was read from the database, which bounds how
+// long a revoked permission can still be used when the change isn't made through this
+// instance of the API. Changes made through this instance invalidate the affected
+// entries straight away. A ttl of zero turns the cache off.
+type permissionCache struct {
+	ttl  time.Duration
+	load func(userID int64) (data.Permissions, error)
+
+	mu      sync.Mutex
+	entries map[int64]permissionCacheEntry
+	// The generation is incremented by every invalidation. A load which overlapped with
+	// an invalidation may have read the old permissions, so its result isn't stored.
+	generation uint64
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type permissionCacheEntry struct {
+	permissions data.Permissions
+	expires     time.Time
+}
+
+// The newPermissionCache() function returns a cache which reads permissions using load
+// and keeps them for ttl. Like the rate limiter, it launches a background goroutine
+// which removes expired entries once every minute.
+func newPermissionCache(ttl time.Duration, load func(userID int64) (data.Permissions, error)) *permissionCache {
+	c := &permissionCache{
+		ttl:     ttl,
+		load:    load,
+		entries: make(map[int64]permissionCacheEntry),
+	}
+	if ttl > 0 {
+		go func() {
+			for {
+				time.Sleep(time.Minute)
+				now := time.Now()
+				c.mu.Lock()
+				for userID, entry := range c.entries {
+					if !now.Before(entry.expires) {
+						delete(c.entries, userID)
+					}
+				}
+				c.mu.Unlock()
+			}
+		}()
+	}
+	return c
+}
+
+// The get() method returns the permissions of a user, from the cache if it holds an
+// entry which hasn't expired, or else from the database. The returned slice is shared,
+// so callers mustn't modify it.
+func (c *permissionCache) get(userID int64) (data.Permissions, error) {
+	if c.ttl <= 0 {
+		c.misses.Add(1)
+		return c.load(userID)
+	}
+	// Take the time before reading from the database, so that an entry expires no later
+	// than ttl after the moment its permissions were known to be current.
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[userID]
+	generation := c.generation
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		c.hits.Add(1)
+		return entry.permissions, nil
+	}
+
+	c.misses.Add(1)
+	permissions, err := c.load(userID)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.generation == generation {
+		c.entries[userID] = permissionCacheEntry{permissions: permissions, expires: now.Add(c.ttl)}
+	}
+	c.mu.Unlock()
+	return permissions, nil
+}
+
+// The invalidate() method forgets the cached permissions of the given users, and must
+// be called whenever permissions or roles are granted to or revoked from them.
+func (c *permissionCache) invalidate(userIDs ...int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for _, userID := range userIDs {
+		delete(c.entries, userID)
+	}
+}
+
+// The invalidateAll() method forgets every cached entry. It is used when a change, like
+// editing a role, can affect the permissions of any number of users.
+func (c *permissionCache) invalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries = make(map[int64]permissionCacheEntry)
+}
+
+// The stats() method returns the cache's counters for monitoring.
+func (c *permissionCache) stats() map[string]any {
+	c.mu.Lock()
+	entries := len(c.entries)
+	c.mu.Unlock()
+	return map[string]any{
+		"hits":        c.hits.Load(),
+		"misses":      c.misses.Load(),
+		"entries":     entries,
+		"ttl_seconds": c.ttl.Seconds(),
+	}
+}
+
+// The showPermissionCacheHandler() lets administrators and monitoring clients (using an
+// API key) see how well the permission cache is working.
+func (app *application) showPermissionCacheHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"permission_cache": app.permissions.stats()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
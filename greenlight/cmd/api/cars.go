@@ -4,65 +4,45 @@ import (
 	"errors"
 	"fmt"
 	"github.com/fara/fakeauto/internal/data"
+	"github.com/fara/fakeauto/internal/jsonpatch"
 	"github.com/fara/fakeauto/internal/validator"
 	"net/http"
+	"strconv"
 )
 
-func (app *application) createCarHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		Name         string  `json:"name"`
-		Body         string  `json:"body"`
-		BrakeSystem  string  `json:"brake_system"`
-		Aspiration   string  `json:"aspiration"`
-		Horsepower   float64 `json:"horsepower"`
-		Mpg          float64 `json:"mpg"`
-		Cylinders    int64   `json:"cylinders"`
-		Acceleration float64 `json:"acceleration"`
-		Displacement float64 `json:"displacement"`
-		Origin       string  `json:"origin"`
-	}
-
-	err := app.readJSON(w, r, &input)
-	if err != nil {
-		app.errorResponse(w, r, http.StatusBadRequest, err.Error())
-	}
-
-	v := validator.New()
-
-	v.Check(input.Name != "", "name", "must be provided")
-	v.Check(len(input.Name) <= 500, "name", "must not be more than 500 bytes long")
-
-	v.Check(input.Body != "", "body", "must be provided")
-	v.Check(len(input.Body) <= 50, "body", "must not be more than 50 bytes long")
-
-	v.Check(input.BrakeSystem != "", "brake_system", "must be provided")
-	v.Check(len(input.BrakeSystem) <= 50, "brake_system", "must not be more than 50 bytes long")
-
-	v.Check(input.Aspiration != "", "aspiration", "must be provided")
-	v.Check(len(input.Aspiration) <= 50, "aspiration", "must not be more than 50 bytes long")
-
-	v.Check(input.Horsepower != 0, "horsepower", "must be provided")
-	v.Check(input.Horsepower <= 2000, "horsepower", "must be less than 2000")
-
-	v.Check(input.Mpg != 0, "mpg", "must be provided")
-
-	v.Check(input.Cylinders != 0, "cylinders", "must be provided")
-	v.Check(input.Cylinders%2 == 0 && input.Cylinders != 2, "cylinders", "must be 4, 6, 8, 12 etc...")
-
-	v.Check(input.Acceleration != 0, "acceleration", "must be provided")
-
-	v.Check(input.Displacement != 0, "displacement", "must be provided")
-
-	v.Check(input.Origin != "", "origin", "must be provided")
-	v.Check(len(input.Origin) <= 50, "origin", "must not be more than 50 bytes long")
+// The numeric columns which can be filtered by range ("horsepower_min=150"), and the
+// columns which can be filtered by a list of values ("cylinders=4,6"), on the cars
+// listing, facets and export endpoints, the fields which can be requested as a sparse
+// fieldset ("fields=id,name,horsepower"), and the columns which can be sorted on.
+var (
+	carSortSafelist = data.SortSafelist("id", "name", "body", "brake_system", "aspiration", "horsepower",
+		"mpg", "cylinders", "acceleration", "displacement", "origin", "created_at")
+	carFieldSafelist = []string{"id", "name", "body", "brake_system", "aspiration", "horsepower", "mpg", "cylinders",
+		"acceleration", "displacement", "origin", "version"}
+	carRangeSafelist = []string{"horsepower", "mpg", "cylinders", "acceleration", "displacement"}
+	carValueSafelist = []string{"body", "brake_system", "aspiration", "cylinders", "origin"}
+	// The trash listing can also be sorted on, and return, the time each car was deleted.
+	carTrashSortSafelist  = append(data.SortSafelist("deleted_at"), carSortSafelist...)
+	carTrashFieldSafelist = append([]string{"deleted_at"}, carFieldSafelist...)
+)
 
-	if !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
-		return
-	}
-	fmt.Fprintf(w, "%+v\n", input)
+// A carInput holds the fields of a car supplied by the client when creating one, either
+// through createCarHandler or as a row of a bulk import.
+type carInput struct {
+	Name         string  `json:"name"`
+	Body         string  `json:"body"`
+	BrakeSystem  string  `json:"brake_system"`
+	Aspiration   string  `json:"aspiration"`
+	Horsepower   float64 `json:"horsepower"`
+	Mpg          float64 `json:"mpg"`
+	Cylinders    int64   `json:"cylinders"`
+	Acceleration float64 `json:"acceleration"`
+	Displacement float64 `json:"displacement"`
+	Origin       string  `json:"origin"`
+}
 
-	car := &data.Car{
+func (input carInput) car() *data.Car {
+	return &data.Car{
 		Name:         input.Name,
 		Body:         input.Body,
 		BrakeSystem:  input.BrakeSystem,
@@ -74,8 +54,26 @@ func (app *application) createCarHandler(w http.ResponseWriter, r *http.Request)
 		Displacement: input.Displacement,
 		Origin:       input.Origin,
 	}
+}
 
-	err = app.models.Cars.Insert(car)
+func (app *application) createCarHandler(w http.ResponseWriter, r *http.Request) {
+	var input carInput
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	car := input.car()
+
+	v := validator.New()
+	if data.ValidateCar(v, car); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Cars.Insert(car, app.contextGetUser(r).ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -95,9 +93,28 @@ func (app *application) showCarHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
 		app.notFoundResponse(w, r)
+		return
 	}
 
-	car, err := app.models.Cars.Get(id)
+	v := validator.New()
+	qs := r.URL.Query()
+	fields := app.readCSV(qs, "fields", nil)
+	data.ValidateFields(v, fields, carFieldSafelist)
+	// An as_of_version parameter asks for the car as it was at a past version, which
+	// is rebuilt from its history.
+	asOfVersion := app.readInt(qs, "as_of_version", 0, v)
+	v.Check(asOfVersion > 0 || !qs.Has("as_of_version"), "as_of_version", "must be greater than zero")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var car *data.Car
+	if asOfVersion > 0 {
+		car, err = app.models.Cars.GetVersion(id, int32(asOfVersion))
+	} else {
+		car, err = app.models.Cars.Get(id, fields...)
+	}
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -107,9 +124,22 @@ func (app *application) showCarHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	// Encode the struct to JSON and send it as the HTTP response.
-	// using envelope
-	err = app.writeJSON(w, http.StatusOK, envelope{"car": car}, nil)
+	// Send the ETag for this version and fieldset, and if the client already holds it
+	// then there's no need to send the record again.
+	headers := make(http.Header)
+	headers.Set("ETag", etag(car.ID, car.Version, fields...))
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, headers.Get("ETag"), true) {
+		w.Header().Set("ETag", headers.Get("ETag"))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	// Encode the struct to JSON and send it as the HTTP response, trimmed down to the
+	// requested fields if the client asked for a sparse fieldset.
+	var body any = car
+	if fields != nil {
+		body = car.Project(fields)
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"car": body}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -133,120 +163,207 @@ func (app *application) updateCarHandler(w http.ResponseWriter, r *http.Request)
 		return
 
 	}
-	// Use pointers for the Title, Year and Runtime fields.
-	var input struct {
-		Name         *string  `json:"name"`
-		Body         *string  `json:"body"`
-		BrakeSystem  *string  `json:"brake_system"`
-		Aspiration   *string  `json:"aspiration"`
-		Horsepower   *float64 `json:"horsepower"`
-		Mpg          *float64 `json:"mpg"`
-		Cylinders    *int64   `json:"cylinders"`
-		Acceleration *float64 `json:"acceleration"`
-		Displacement *float64 `json:"displacement"`
-		Origin       *string  `json:"origin"`
+	// Only the owner may edit the car, unless the user may edit any car.
+	if !app.checkOwner(w, r, car.CreatedBy, "cars:write:any") {
+		return
 	}
-	// Decode the JSON as normal.
-	err = app.readJSON(w, r, &input)
+	// Refuse to apply the changes unless the client is editing the version it last
+	// retrieved.
+	if !app.checkIfMatch(w, r, etag(car.ID, car.Version)) {
+		return
+	}
+	// Apply the patch document from the request body to the car. This accepts both
+	// JSON Merge Patch and JSON Patch documents, see readPatch().
+	version := car.Version
+	err = app.readPatch(w, r, car)
 	if err != nil {
-		app.badRequestResponse(w, r, err)
+		switch {
+		case errors.Is(err, errUnsupportedMediaType):
+			app.unsupportedMediaTypeResponse(w, r)
+		case errors.Is(err, jsonpatch.ErrTestFailed):
+			app.patchTestFailedResponse(w, r, err)
+		case errors.Is(err, jsonpatch.ErrPathNotFound):
+			app.unprocessablePatchResponse(w, r, err)
+		default:
+			app.badRequestResponse(w, r, err)
+		}
 		return
 	}
 
-	if input.Name != nil {
-		car.Name = *input.Name
-	}
-	// We also do the same for the other fields in the input struct.
-	if input.Body != nil {
-		car.Body = *input.Body
-	}
-	if input.BrakeSystem != nil {
-		car.BrakeSystem = *input.BrakeSystem
-	}
-	if input.Aspiration != nil {
-		car.Aspiration = *input.Aspiration // Note that we don't need to dereference a slice.
+	v := validator.New()
+	// The id and version are managed by the database, so a patch mustn't change them.
+	v.Check(car.ID == id, "id", "must not be changed")
+	v.Check(car.Version == version, "version", "must not be changed")
+	v.Check(car.DeletedAt == nil, "deleted_at", "must not be changed")
+	if data.ValidateCar(v, car); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
 	}
-	if input.Horsepower != nil {
-		car.Horsepower = *input.Horsepower
+
+	err = app.models.Cars.Update(car, app.contextGetUser(r).ID)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
 	}
-	// We also do the same for the other fields in the input struct.
-	if input.Mpg != nil {
-		car.Mpg = *input.Mpg
+	// Send the ETag of the new version so the client can make further changes.
+	headers := make(http.Header)
+	headers.Set("ETag", etag(car.ID, car.Version))
+	err = app.writeJSON(w, http.StatusOK, envelope{"car": car}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
 	}
-	if input.Cylinders != nil {
-		car.Cylinders = *input.Cylinders
+
+}
+
+func (app *application) deleteCarHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
 	}
-	if input.Acceleration != nil {
-		car.Acceleration = *input.Acceleration // Note that we don't need to dereference a slice.
+
+	// Look up the current version and owner first, so we can tell a missing record from
+	// a stale If-Match header.
+	car, err := app.models.Cars.Get(id, "version", "created_by")
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
 	}
-	if input.Displacement != nil {
-		car.Displacement = *input.Displacement
+	if !app.checkOwner(w, r, car.CreatedBy, "cars:delete:any") {
+		return
 	}
-	if input.Origin != nil {
-		car.Origin = *input.Origin // Note that we don't need to dereference a slice.
+	if !app.checkIfMatch(w, r, etag(car.ID, car.Version)) {
+		return
 	}
 
-	v := validator.New()
-
-	v.Check(car.Name != "", "name", "must be provided")
-	v.Check(len(car.Name) <= 500, "name", "must not be more than 500 bytes long")
-
-	v.Check(car.Body != "", "body", "must be provided")
-	v.Check(len(car.Body) <= 50, "body", "must not be more than 50 bytes long")
-
-	v.Check(car.BrakeSystem != "", "brake_system", "must be provided")
-	v.Check(len(car.BrakeSystem) <= 50, "brake_system", "must not be more than 50 bytes long")
-
-	v.Check(car.Aspiration != "", "aspiration", "must be provided")
-	v.Check(len(car.Aspiration) <= 50, "aspiration", "must not be more than 50 bytes long")
-
-	v.Check(car.Horsepower != 0, "horsepower", "must be provided")
-	v.Check(car.Horsepower <= 2000, "horsepower", "must be less than 2000")
+	err = app.models.Cars.Delete(car.ID, car.Version, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
 
-	v.Check(car.Mpg != 0, "mpg", "must be provided")
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "car successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 
-	v.Check(car.Cylinders != 0, "cylinders", "must be provided")
-	v.Check(car.Cylinders%2 == 0 && car.Cylinders != 2, "cylinders", "must be 4, 6, 8, 12 etc...")
+}
 
-	v.Check(car.Acceleration != 0, "acceleration", "must be provided")
+func (app *application) restoreCarHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
 
-	v.Check(car.Displacement != 0, "displacement", "must be provided")
+	// Only the owner may restore the car, unless the user may delete any car.
+	createdBy, err := app.models.Cars.GetOwner(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !app.checkOwner(w, r, createdBy, "cars:delete:any") {
+		return
+	}
 
-	v.Check(car.Origin != "", "origin", "must be provided")
-	v.Check(len(car.Origin) <= 50, "origin", "must not be more than 50 bytes long")
+	err = app.models.Cars.Restore(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
 
-	if !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+	// Send back the restored car along with the ETag of its new version.
+	car, err := app.models.Cars.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
-	fmt.Fprintf(w, "%+v\n", input)
+	headers := make(http.Header)
+	headers.Set("ETag", etag(car.ID, car.Version))
+	err = app.writeJSON(w, http.StatusOK, envelope{"car": car}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
 
-	err = app.models.Cars.Update(car)
+func (app *application) purgeCarHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
 
+	// Only cars which are already in the trash can be purged, so there's no need for an
+	// If-Match header here: nobody can edit a deleted record in the meantime.
+	err = app.models.Cars.Purge(id, app.contextGetUser(r).ID)
 	if err != nil {
 		switch {
-		case errors.Is(err, data.ErrEditConflict):
-			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
-	err = app.writeJSON(w, http.StatusOK, envelope{"car": car}, nil)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "car successfully purged"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
-
 }
 
-func (app *application) deleteCarHandler(w http.ResponseWriter, r *http.Request) {
+func (app *application) carHistoryHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
 		app.notFoundResponse(w, r)
 		return
 	}
 
-	err = app.models.Cars.Delete(id)
+	v := validator.New()
+	qs := r.URL.Query()
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readString(qs, "sort", "id"),
+		SortSafelist: data.HistorySortSafelist,
+	}
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	history, metadata, err := app.models.Cars.History(id, filters)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -257,39 +374,190 @@ func (app *application) deleteCarHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "car successfully deleted"}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"history": history, "metadata": metadata}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
-
 }
 
 func (app *application) listCarsHandler(w http.ResponseWriter, r *http.Request) {
+	app.listCars(w, r, false, 0)
+}
+
+func (app *application) trashCarsHandler(w http.ResponseWriter, r *http.Request) {
+	app.listCars(w, r, true, 0)
+}
+
+// The listCurrentUserCarsHandler() lists the cars created by the caller, taking the
+// same parameters as listCarsHandler().
+func (app *application) listCurrentUserCarsHandler(w http.ResponseWriter, r *http.Request) {
+	app.listCars(w, r, false, app.contextGetUser(r).ID)
+}
+
+// The listCars() helper serves both the regular listing and the trash, which accept the
+// same query string parameters and only differ in which cars they return. A non-zero
+// createdBy only lists the cars created by that user.
+func (app *application) listCars(w http.ResponseWriter, r *http.Request, deleted bool, createdBy int64) {
+	sortSafelist, fieldSafelist := carSortSafelist, carFieldSafelist
+	if deleted {
+		sortSafelist, fieldSafelist = carTrashSortSafelist, carTrashFieldSafelist
+	}
+
 	var input struct {
-		Name string
+		data.SearchFilters
 		data.Filters
 	}
 	v := validator.New()
 	qs := r.URL.Query()
-	input.Name = app.readString(qs, "name", "")
+	// Read the name term together with the range and value filters, e.g.
+	// ?horsepower_min=150&horsepower_max=300&cylinders=4,6
+	input.SearchFilters = app.readSearchFilters(qs, carRangeSafelist, carValueSafelist, v)
+	input.SearchFilters.Deleted = deleted
+	input.SearchFilters.CreatedBy = createdBy
 
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	// An opaque cursor from a previous response's next_cursor or prev_cursor switches
+	// to keyset paging, which stays consistent while the inventory changes.
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+	fields := app.readCSV(qs, "fields", nil)
+	data.ValidateFields(v, fields, fieldSafelist)
 	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafelist = []string{"id", "name", "body", "-id", "-name", "-body"}
+	input.Filters.SortSafelist = sortSafelist
+	input.Filters.Record = &data.Car{}
+	data.ValidateSearchFilters(v, input.SearchFilters)
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 	// Accept the metadata struct as a return value.
-	cars, metadata, err := app.models.Cars.GetAll(input.Name, input.Filters)
+	cars, metadata, err := app.models.Cars.GetAll(input.SearchFilters, input.Filters, fields...)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	var body any = cars
+	if fields != nil {
+		body = projectAll(cars, fields)
+	}
 	// Include the metadata in the response envelope.
-	err = app.writeJSON(w, http.StatusOK, envelope{"cars": cars, "metadata": metadata}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"cars": body, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) carFacetsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	// Facets honour exactly the same filters as the listing endpoint.
+	search := app.readSearchFilters(qs, carRangeSafelist, carValueSafelist, v)
+	if data.ValidateSearchFilters(v, search); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	facets, err := app.models.Cars.Facets(search)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"facets": facets}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) importCarsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	dryRun, err := strconv.ParseBool(app.readString(r.URL.Query(), "dry_run", "false"))
+	if err != nil {
+		v.AddError("dry_run", "must be a boolean value")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	inputs, rowErrors, warnings, err := readImport[carInput](w, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, errUnsupportedMediaType):
+			app.unsupportedMediaTypeResponse(w, r)
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+
+	// Validate every row with the same rules as createCarHandler, collecting the valid
+	// cars along with the position of their row in the report.
+	report := importReport{DryRun: dryRun, Total: len(inputs), Warnings: warnings}
+	var cars []*data.Car
+	var reportIndex []int
+	for i, input := range inputs {
+		row := importRow{Row: i + 1, Errors: rowErrors[i]}
+		if row.Errors == nil {
+			car := input.car()
+			v := validator.New()
+			if data.ValidateCar(v, car); v.Valid() {
+				cars = append(cars, car)
+				reportIndex = append(reportIndex, i)
+			} else {
+				row.Errors = v.Errors
+			}
+		}
+		report.Rows = append(report.Rows, row)
+	}
+	report.Accepted = len(cars)
+	report.Rejected = report.Total - report.Accepted
+
+	if !dryRun && len(cars) > 0 {
+		err = app.models.Cars.InsertMany(cars, app.contextGetUser(r).ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		for i, car := range cars {
+			report.Rows[reportIndex[i]].ID = car.ID
+		}
+	}
+
+	app.writeImportReport(w, r, report)
+}
+
+func (app *application) exportCarsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	// Exports take the same filters and sort keys as the listing endpoint, but aren't
+	// paged. The fields parameter picks the exported columns.
+	search := app.readSearchFilters(qs, carRangeSafelist, carValueSafelist, v)
+	filters := data.Filters{
+		Sort:         app.readString(qs, "sort", "id"),
+		SortSafelist: carSortSafelist,
+	}
+	fields := app.readCSV(qs, "fields", carFieldSafelist)
+	data.ValidateSearchFilters(v, search)
+	data.ValidateSort(v, filters)
+	if data.ValidateFields(v, fields, carFieldSafelist); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	format, ok := negotiateExportFormat(r.Header.Get("Accept"))
+	if !ok {
+		app.notAcceptableResponse(w, r, exportFormats)
+		return
+	}
+
+	// Use the request context rather than a fixed timeout, so the export runs for as
+	// long as the client keeps reading and stops if it goes away. The exporter keeps
+	// pushing back the server's write deadline for the same reason.
+	e := newExporter(w, format, "cars", fields)
+	err := app.models.Cars.Export(r.Context(), search, filters, func(car *data.Car) error {
+		return e.write(car)
+	}, fields...)
+	if err == nil {
+		err = e.finish()
+	}
+	if err != nil {
+		app.exportFailed(w, r, e, err)
+	}
+}
@@ -14,6 +14,21 @@ type contextKey string
 // in the request context.
 const userContextKey = contextKey("user")
 
+// The tokenContextKey holds the plaintext authentication token the request was made
+// with, so that handlers can tell which of the user's sessions is the current one.
+const tokenContextKey = contextKey("token")
+
+// When a request is made with a signed token, which isn't stored in the database, the
+// sessionIDContextKey and permissionsContextKey hold the session id and the permissions
+// carried in the token.
+const (
+	sessionIDContextKey   = contextKey("sessionID")
+	permissionsContextKey = contextKey("permissions")
+)
+
+// The apiKeyContextKey holds the API key a request was made with, if any.
+const apiKeyContextKey = contextKey("apiKey")
+
 // The contextSetUser() method returns a new copy of the request with the provided
 // User struct added to the context. Note that we use our userContextKey constant as the
 // key.
@@ -33,3 +48,61 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// The contextSetToken() method returns a new copy of the request with the plaintext
+// authentication token added to the context.
+func (app *application) contextSetToken(r *http.Request, token string) *http.Request {
+	ctx := context.WithValue(r.Context(), tokenContextKey, token)
+	return r.WithContext(ctx)
+}
+
+// The contextGetToken() method retrieves the plaintext authentication token from the
+// request context, returning the empty string if the request wasn't authenticated with
+// one.
+func (app *application) contextGetToken(r *http.Request) string {
+	token, _ := r.Context().Value(tokenContextKey).(string)
+	return token
+}
+
+// The contextSetSessionID() method returns a new copy of the request with the id of the
+// session (token family) the request was made from added to the context.
+func (app *application) contextSetSessionID(r *http.Request, id int64) *http.Request {
+	ctx := context.WithValue(r.Context(), sessionIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// The contextGetSessionID() method retrieves the session id from the request context,
+// returning zero if it isn't known.
+func (app *application) contextGetSessionID(r *http.Request) int64 {
+	id, _ := r.Context().Value(sessionIDContextKey).(int64)
+	return id
+}
+
+// The contextSetPermissions() method returns a new copy of the request with the user's
+// permissions added to the context.
+func (app *application) contextSetPermissions(r *http.Request, permissions data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+// The contextGetPermissions() method retrieves the user's permissions from the request
+// context. The boolean result is false if they weren't set, in which case they need to
+// be read from the database.
+func (app *application) contextGetPermissions(r *http.Request) (data.Permissions, bool) {
+	permissions, ok := r.Context().Value(permissionsContextKey).(data.Permissions)
+	return permissions, ok
+}
+
+// The contextSetAPIKey() method returns a new copy of the request with the API key it
+// was made with added to the context.
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// The contextGetAPIKey() method retrieves the API key the request was made with, or nil
+// if it wasn't made with one.
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The formats an export can be streamed in. The first one is used when the client
+// doesn't express a preference.
+var exportFormats = []string{"text/csv", "application/x-ndjson", "application/json"}
+
+// The negotiateExportFormat() function picks the export format from the Accept header.
+// Each format gets the quality (q-value) of the most specific media range which
+// matches it, and the format with the highest quality wins. Formats with a quality of
+// zero are never picked. Between formats of equal quality, the one whose range the
+// client listed first wins, then the one listed first in exportFormats. Media ranges
+// which can't be parsed, or whose q-value is invalid, are ignored.
+func negotiateExportFormat(accept string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return exportFormats[0], true
+	}
+	type mediaRange struct {
+		mediaType string
+		quality   float64
+	}
+	var ranges []mediaRange
+	for _, s := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(s)
+		if err != nil {
+			continue
+		}
+		quality, ok := parseQuality(params["q"])
+		if !ok {
+			continue
+		}
+		ranges = append(ranges, mediaRange{mediaType, quality})
+	}
+
+	best, bestQuality, bestPosition := "", 0.0, 0
+	for _, format := range exportFormats {
+		// Find the most specific range matching the format: an exact match beats
+		// type/*, which beats */*.
+		position, specificity := -1, 0
+		for i, mr := range ranges {
+			var s int
+			switch mr.mediaType {
+			case format:
+				s = 3
+			case strings.Split(format, "/")[0] + "/*":
+				s = 2
+			case "*/*":
+				s = 1
+			}
+			if s > specificity {
+				position, specificity = i, s
+			}
+		}
+		if position < 0 {
+			continue
+		}
+		quality := ranges[position].quality
+		if quality > bestQuality || (quality == bestQuality && quality > 0 && position < bestPosition) {
+			best, bestQuality, bestPosition = format, quality, position
+		}
+	}
+	return best, best != ""
+}
+
+// The parseQuality() function parses the q parameter of a media range, which must be a
+// number from 0 to 1 with at most three decimal places. A missing q-value means 1.
+func parseQuality(q string) (float64, bool) {
+	if q == "" {
+		return 1, true
+	}
+	if len(q) > 5 || (q[0] != '0' && q[0] != '1') || (len(q) > 1 && q[1] != '.') {
+		return 0, false
+	}
+	quality, err := strconv.ParseFloat(q, 64)
+	if err != nil || quality > 1 {
+		return 0, false
+	}
+	return quality, true
+}
+
+// A large export takes far longer to stream than the server's WriteTimeout allows for a
+// whole response. Instead of a fixed deadline, an exporter gives the client
+// exportWriteTimeout from each record it writes, so a client which stops reading still
+// times out but one which keeps reading can download an export of any size.
+const exportWriteTimeout = 30 * time.Second
+
+// An exporter streams records to the client in the negotiated format as they are read
+// from the database. Nothing is written until the first record (or finish()), so if the
+// query fails straight away the handler can still send a normal error response.
+type exporter struct {
+	w       http.ResponseWriter
+	rc      *http.ResponseController
+	format  string
+	name    string
+	fields  []string
+	csv     *csv.Writer
+	started bool
+	rows    int
+}
+
+func newExporter(w http.ResponseWriter, format, name string, fields []string) *exporter {
+	e := &exporter{w: w, rc: http.NewResponseController(w), format: format, name: name, fields: fields}
+	// Give the query the same time to return its first record as it has between
+	// records. An error here means the connection is broken, which the first write will
+	// report anyway.
+	_ = e.extendDeadline()
+	return e
+}
+
+// The extendDeadline() method moves the write deadline to exportWriteTimeout from now.
+// If the ResponseWriter doesn't support deadlines the server's WriteTimeout applies.
+func (e *exporter) extendDeadline() error {
+	err := e.rc.SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
+
+func (e *exporter) start() error {
+	e.started = true
+	extension := map[string]string{"text/csv": "csv", "application/x-ndjson": "ndjson", "application/json": "json"}[e.format]
+	e.w.Header().Set("Content-Type", e.format)
+	e.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", e.name+"."+extension))
+	e.w.WriteHeader(http.StatusOK)
+
+	switch e.format {
+	case "text/csv":
+		e.csv = csv.NewWriter(e.w)
+		return e.csv.Write(e.fields)
+	case "application/json":
+		_, err := fmt.Fprintf(e.w, `{%q:[`, e.name)
+		return err
+	}
+	return nil
+}
+
+// The write() method sends a single record, trimmed to the exported fields.
+func (e *exporter) write(record projector) error {
+	if err := e.extendDeadline(); err != nil {
+		return err
+	}
+	if !e.started {
+		if err := e.start(); err != nil {
+			return err
+		}
+	}
+	projection := record.Project(e.fields)
+
+	var err error
+	switch e.format {
+	case "text/csv":
+		row := make([]string, len(e.fields))
+		for i, field := range e.fields {
+			row[i] = formatCell(projection[field])
+		}
+		err = e.csv.Write(row)
+	case "application/x-ndjson":
+		err = json.NewEncoder(e.w).Encode(projection)
+	case "application/json":
+		if e.rows > 0 {
+			if _, err = e.w.Write([]byte(",")); err != nil {
+				return err
+			}
+		}
+		var js []byte
+		js, err = json.Marshal(projection)
+		if err == nil {
+			_, err = e.w.Write(js)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// Flush the response every so often, so the client receives the export as it is
+	// produced rather than in one go at the end.
+	e.rows++
+	if e.rows%100 == 0 {
+		e.flush()
+	}
+	return nil
+}
+
+// The finish() method completes the export, which for an empty export still sends the
+// CSV header or an empty JSON array.
+func (e *exporter) finish() error {
+	if !e.started {
+		if err := e.start(); err != nil {
+			return err
+		}
+	}
+	if e.format == "application/json" {
+		if _, err := e.w.Write([]byte("]}\n")); err != nil {
+			return err
+		}
+	}
+	e.flush()
+	if e.csv != nil {
+		return e.csv.Error()
+	}
+	return nil
+}
+
+func (e *exporter) flush() {
+	if e.csv != nil {
+		e.csv.Flush()
+	}
+	if f, ok := e.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func formatCell(value any) string {
+	switch value := value.(type) {
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// The exportFailed() helper handles an error during an export. If nothing has been sent
+// yet we can still respond with a 500 Internal Server Error. Otherwise the status line
+// has already gone out, so all we can do is log the error; the truncated body (with no
+// closing bracket, for JSON) tells the client the export is incomplete.
+func (app *application) exportFailed(w http.ResponseWriter, r *http.Request, e *exporter, err error) {
+	if !e.started {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.logError(r, err)
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestNegotiateExportFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "text/csv"},
+		{"*/*", "text/csv"},
+		{"application/json", "application/json"},
+		{"application/json, text/csv", "application/json"},
+		{"text/csv;q=0.5, application/json", "application/json"},
+		{"application/json;q=0.2, application/x-ndjson;q=0.8", "application/x-ndjson"},
+		{"application/*;q=0.9, application/json;q=0.1", "application/x-ndjson"},
+		{"*/*;q=0.1, text/csv;q=0", "application/x-ndjson"},
+		{"text/*", "text/csv"},
+		{"text/csv;q=0.000", ""},
+		{"text/csv;q=0, */*;q=0", ""},
+		{"text/csv;q=2, application/json", "application/json"},
+		{"text/csv;q=0.5000", ""},
+		{"text/csv;q=abc", ""},
+		{"text/html, application/xml", ""},
+	}
+	for _, tt := range tests {
+		got, ok := negotiateExportFormat(tt.accept)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("negotiateExportFormat(%q) = %q, %v, want %q", tt.accept, got, ok, tt.want)
+		}
+	}
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/fara/fakeauto/internal/data"
+	"github.com/fara/fakeauto/internal/jsonpatch"
 	"github.com/fara/fakeauto/internal/validator"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -29,6 +35,22 @@ func (app *application) readIDParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+// httprouter doesn't allow a fixed path segment to share its position with a named
+// parameter, so collection-level actions such as /v1/cars/facets can't be registered
+// alongside /v1/cars/:id. Instead they are registered on the :id route, and the
+// routeByID() helper dispatches to the action handler named by the parameter, falling
+// back to the regular handler for everything else.
+func (app *application) routeByID(next http.HandlerFunc, actions map[string]http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := httprouter.ParamsFromContext(r.Context())
+		if action, ok := actions[params.ByName("id")]; ok {
+			action(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
+
 // in my version of go there is no type as 'any', and instead of it I used interface{},
 // cuz Marshal actually accepts it as a parameter and map is implementing interface.
 // on your side data interface{} must be data any if you are using go version 1.18 or newer
@@ -84,6 +106,155 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 	return nil
 }
 
+// The etag() helper returns the entity tag for a version of a record. The version is
+// incremented on every update, so the id and version together identify the state of
+// the record. A sparse fieldset is a different representation of the record, so its
+// fields are part of the tag too, sorted so that the order they were asked for in
+// doesn't matter. Only the tag of the full record is accepted by If-Match.
+func etag(id int64, version int32, fields ...string) string {
+	if len(fields) == 0 {
+		return fmt.Sprintf(`"%d-%d"`, id, version)
+	}
+	sorted := append([]string(nil), fields...)
+	sort.Strings(sorted)
+	return fmt.Sprintf(`"%d-%d-%s"`, id, version, strings.Join(sorted, ","))
+}
+
+// The etagMatches() helper reports whether a conditional request header, which holds
+// either "*" or a comma-separated list of entity tags, matches the current entity tag.
+// If-None-Match uses the weak comparison (which ignores a W/ prefix), and If-Match uses
+// the strong comparison (where a weak tag never matches).
+func etagMatches(header, current string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == current {
+			return true
+		}
+	}
+	return false
+}
+
+// The checkOwner() helper enforces that only the owner of a vehicle, the user who
+// created it, or a user holding the elevated anyCode permission (like "cars:write:any")
+// may change it. It sends a 403 Forbidden response and returns false if the user making
+// the request is neither.
+func (app *application) checkOwner(w http.ResponseWriter, r *http.Request, createdBy *int64, anyCode string) bool {
+	if createdBy != nil && *createdBy == app.contextGetUser(r).ID {
+		return true
+	}
+	permissions, err := app.userPermissions(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+	if !permissions.Include(anyCode) {
+		app.notPermittedResponse(w, r)
+		return false
+	}
+	return true
+}
+
+// The checkIfMatch() helper enforces the If-Match precondition on requests which change
+// a record. It sends a 428 Precondition Required response if the header is missing, or
+// a 412 Precondition Failed response if it doesn't match the record's current ETag, and
+// returns false in either case.
+func (app *application) checkIfMatch(w http.ResponseWriter, r *http.Request, current string) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		app.preconditionRequiredResponse(w, r)
+		return false
+	}
+	if !etagMatches(header, current, false) {
+		app.preconditionFailedResponse(w, r)
+		return false
+	}
+	return true
+}
+
+// errUnsupportedMediaType is returned by readPatch() when the request body is in a
+// format it can't apply.
+var errUnsupportedMediaType = errors.New("unsupported media type")
+
+// The readPatch() helper applies the patch document in the request body to dst, which
+// must be a pointer to a record struct. The Content-Type header selects the format:
+// application/merge-patch+json (RFC 7396) or application/json-patch+json (RFC 6902).
+// Plain application/json bodies, which is what existing clients send, are treated as a
+// merge patch. The patch is applied to the record's JSON representation, so a merge
+// patch member set to null, or a JSON Patch "remove", resets that field to its zero
+// value, and the result is decoded back into dst. Fields which aren't part of the JSON
+// representation (like CreatedAt) are carried over untouched.
+func (app *application) readPatch(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	mediaType := "application/json"
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		var err error
+		mediaType, _, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return errUnsupportedMediaType
+		}
+	}
+	var apply func(doc, patch []byte) ([]byte, error)
+	switch mediaType {
+	case "application/json", "application/merge-patch+json":
+		apply = jsonpatch.MergePatch
+	case "application/json-patch+json":
+		apply = jsonpatch.Apply
+	default:
+		return errUnsupportedMediaType
+	}
+
+	patch, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1_048_576))
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(patch)) == 0 {
+		return errors.New("body must not be empty")
+	}
+	doc, err := json.Marshal(dst)
+	if err != nil {
+		return err
+	}
+	patched, err := apply(doc, patch)
+	if err != nil {
+		return err
+	}
+
+	current := reflect.ValueOf(dst).Elem()
+	fresh := reflect.New(current.Type())
+	dec := json.NewDecoder(bytes.NewReader(patched))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(fresh.Interface())
+	if err != nil {
+		var unmarshalTypeError *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &unmarshalTypeError) && unmarshalTypeError.Field != "":
+			return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+		case errors.As(err, &unmarshalTypeError):
+			return errors.New("patch must produce a JSON object")
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
+			return fmt.Errorf("body contains unknown key %s", fieldName)
+		default:
+			return err
+		}
+	}
+	for i := 0; i < current.NumField(); i++ {
+		if current.Type().Field(i).Tag.Get("json") == "-" {
+			fresh.Elem().Field(i).Set(current.Field(i))
+		}
+	}
+	current.Set(fresh.Elem())
+	return nil
+}
+
 // The background() helper accepts an arbitrary function as a parameter.
 func (app *application) background(fn func()) {
 
@@ -151,3 +322,79 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	// Otherwise, return the converted integer value.
 	return i
 }
+
+// A projector is a record which can be trimmed down to a sparse fieldset, like data.Car
+// and data.Motorbike.
+type projector interface {
+	Project(names []string) map[string]any
+}
+
+// The projectAll() helper trims every record in a listing down to the requested fields.
+func projectAll[T projector](records []T, fields []string) []map[string]any {
+	projected := make([]map[string]any, len(records))
+	for i, record := range records {
+		projected[i] = record.Project(fields)
+	}
+	return projected
+}
+
+// The readFloat() helper works like readInt(), but converts the query string value to a
+// float64, recording an error message in the Validator if that isn't possible.
+func (app *application) readFloat(qs url.Values, key string, defaultValue float64, v *validator.Validator) float64 {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		v.AddError(key, "must be a number")
+		return defaultValue
+	}
+	return f
+}
+
+// The readSearchFilters() helper reads the vehicle filter grammar from the query string.
+// Every column in rangeSafelist may be bounded with "<column>_min" and "<column>_max",
+// and every column in valueSafelist may be given a comma-separated list of accepted
+// values, e.g. "cylinders=4,6" or "origin=usa,japan". The numeric columns which take a
+// list of values, like cylinders, hold whole numbers, so their values must be integers,
+// which we check here so the database never sees bad input.
+func (app *application) readSearchFilters(qs url.Values, rangeSafelist, valueSafelist []string, v *validator.Validator) data.SearchFilters {
+	search := data.SearchFilters{
+		Name:          app.readString(qs, "name", ""),
+		Ranges:        make(map[string]data.RangeFilter),
+		Values:        make(map[string][]string),
+		RangeSafelist: rangeSafelist,
+		ValueSafelist: valueSafelist,
+	}
+	for _, column := range rangeSafelist {
+		var r data.RangeFilter
+		if qs.Get(column+"_min") != "" {
+			minValue := app.readFloat(qs, column+"_min", 0, v)
+			r.Min = &minValue
+		}
+		if qs.Get(column+"_max") != "" {
+			maxValue := app.readFloat(qs, column+"_max", 0, v)
+			r.Max = &maxValue
+		}
+		if r.Min != nil || r.Max != nil {
+			search.Ranges[column] = r
+		}
+	}
+	for _, column := range valueSafelist {
+		values := app.readCSV(qs, column, nil)
+		if values == nil {
+			continue
+		}
+		for i := range values {
+			values[i] = strings.TrimSpace(values[i])
+			if validator.PermittedValue(column, rangeSafelist...) {
+				if _, err := strconv.Atoi(values[i]); err != nil {
+					v.AddError(column, "must be a comma-separated list of integers")
+				}
+			}
+		}
+		search.Values[column] = values
+	}
+	return search
+}
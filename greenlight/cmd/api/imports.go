@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Limits on the size of a bulk import request.
+const (
+	maxImportBytes = 10 << 20
+	maxImportRows  = 10_000
+)
+
+// An importRow reports the outcome for a single row of a bulk import: the id of the
+// inserted record, or the validation errors which caused the row to be rejected. Rows
+// are numbered from 1, not counting the CSV header line.
+type importRow struct {
+	Row    int               `json:"row"`
+	ID     int64             `json:"id,omitempty"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+type importReport struct {
+	DryRun   bool        `json:"dry_run"`
+	Total    int         `json:"total"`
+	Accepted int         `json:"accepted"`
+	Rejected int         `json:"rejected"`
+	Warnings []string    `json:"warnings,omitempty"`
+	Rows     []importRow `json:"rows"`
+}
+
+// The readImport() function decodes the rows of a bulk import request body into values
+// of type T, which should be the same input struct used by the matching create handler.
+// The body can be CSV (text/csv), with a header line naming the JSON keys of T, or
+// newline-delimited JSON (application/x-ndjson). A row which can't be decoded doesn't
+// fail the whole request; instead its errors are returned at the same index in
+// rowErrors, so they can be reported alongside the validation errors. Anything else
+// worth telling the client, such as CSV columns which were ignored, is returned in
+// warnings.
+func readImport[T any](w http.ResponseWriter, r *http.Request) (rows []T, rowErrors []map[string]string, warnings []string, err error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil, nil, errUnsupportedMediaType
+	}
+	body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+
+	switch mediaType {
+	case "text/csv":
+		rows, rowErrors, warnings, err = readImportCSV[T](body)
+	case "application/x-ndjson":
+		rows, rowErrors, err = readImportNDJSON[T](body)
+	default:
+		return nil, nil, nil, errUnsupportedMediaType
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil, nil, errors.New("body must contain at least one row")
+	}
+	return rows, rowErrors, warnings, nil
+}
+
+// The readImportCSV() function reads a CSV import. Columns in the header which don't
+// match a JSON key of T are skipped, so that a dataset with extra columns (such as
+// weight or model year in the auto-mpg data) can be imported as it is, and a warning
+// naming each one is returned.
+func readImportCSV[T any](body io.Reader) ([]T, []map[string]string, []string, error) {
+	cr := csv.NewReader(body)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil, nil, errors.New("body must not be empty")
+		}
+		return nil, nil, nil, err
+	}
+
+	// Map each column in the header to the field of T with the matching JSON key.
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	fieldIndex := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		fieldIndex[strings.Split(t.Field(i).Tag.Get("json"), ",")[0]] = i
+	}
+	var warnings []string
+	columns := make([]int, len(header))
+	for i, name := range header {
+		index, ok := fieldIndex[strings.TrimSpace(name)]
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("unknown column %q was ignored", name))
+			index = -1
+		}
+		columns[i] = index
+	}
+
+	var rows []T
+	var rowErrors []map[string]string
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if len(rows) == maxImportRows {
+			return nil, nil, nil, fmt.Errorf("body must not contain more than %d rows", maxImportRows)
+		}
+
+		var row T
+		var errs map[string]string
+		value := reflect.ValueOf(&row).Elem()
+		for i, cell := range record {
+			cell = strings.TrimSpace(cell)
+			if cell == "" || columns[i] < 0 {
+				continue
+			}
+			if err := setField(value.Field(columns[i]), cell); err != nil {
+				if errs == nil {
+					errs = make(map[string]string)
+				}
+				errs[header[i]] = err.Error()
+			}
+		}
+		rows = append(rows, row)
+		rowErrors = append(rowErrors, errs)
+	}
+	return rows, rowErrors, warnings, nil
+}
+
+// The setField() function converts a CSV cell to the kind of the destination field.
+func setField(field reflect.Value, cell string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(cell)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(cell, 10, 64)
+		if err != nil {
+			return errors.New("must be an integer value")
+		}
+		field.SetInt(i)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(cell, 64)
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(cell)
+		if err != nil {
+			return errors.New("must be a boolean value")
+		}
+		field.SetBool(b)
+	default:
+		panic("unsupported import field kind: " + field.Kind().String())
+	}
+	return nil
+}
+
+func readImportNDJSON[T any](body io.Reader) ([]T, []map[string]string, error) {
+	var rows []T
+	var rowErrors []map[string]string
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxImportBytes)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if len(rows) == maxImportRows {
+			return nil, nil, fmt.Errorf("body must not contain more than %d rows", maxImportRows)
+		}
+
+		var row T
+		var errs map[string]string
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&row); err != nil {
+			var unmarshalTypeError *json.UnmarshalTypeError
+			switch {
+			case errors.As(err, &unmarshalTypeError) && unmarshalTypeError.Field != "":
+				errs = map[string]string{unmarshalTypeError.Field: "incorrect JSON type"}
+			case strings.HasPrefix(err.Error(), "json: unknown field "):
+				errs = map[string]string{"row": "contains unknown key " + strings.TrimPrefix(err.Error(), "json: unknown field ")}
+			default:
+				errs = map[string]string{"row": "contains badly-formed JSON"}
+			}
+		} else if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+			// Each line must hold exactly one JSON value, so anything after it is an
+			// error rather than being silently dropped.
+			errs = map[string]string{"row": "must only contain a single JSON object"}
+		}
+		rows = append(rows, row)
+		rowErrors = append(rowErrors, errs)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return rows, rowErrors, nil
+}
+
+// The writeImportReport() helper sends the report for a bulk import. A dry run gets a
+// 200 OK response, an import which inserted records a 201 Created response, and an
+// import where every row was rejected a 422 Unprocessable Entity response.
+func (app *application) writeImportReport(w http.ResponseWriter, r *http.Request, report importReport) {
+	status := http.StatusCreated
+	switch {
+	case report.DryRun:
+		status = http.StatusOK
+	case report.Accepted == 0:
+		status = http.StatusUnprocessableEntity
+	}
+	err := app.writeJSON(w, status, envelope{"report": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/fara/fakeauto/internal/data"
+	"strconv"
+	"time"
+)
+
+// The tokenClaims are the contents of a signed authentication token. They carry
+// everything the authenticate() and requirePermission() middleware need to know about
+// the user, so that requests made with a signed token don't touch the database. The
+// session id is the token family of the refresh token the token was issued alongside.
+type tokenClaims struct {
+	Subject     string           `json:"sub"`
+	SessionID   int64            `json:"sid"`
+	IssuedAt    int64            `json:"iat"`
+	Expiry      int64            `json:"exp"`
+	Activated   bool             `json:"activated"`
+	Permissions data.Permissions `json:"permissions"`
+}
+
+// The storedAuthenticationTTL() method returns the lifetime of the authentication tokens
+// to store in the database when a session is started or refreshed. In JWT mode the
+// authentication tokens are signed instead of stored, so it returns zero.
+func (app *application) storedAuthenticationTTL() time.Duration {
+	if app.jwtKeys != nil {
+		return 0
+	}
+	return app.config.tokens.authenticationTTL
+}
+
+// The newSignedToken() method issues a signed authentication token for a user, holding
+// their current permissions. Since the token can't be revoked, changes to the user's
+// activation status or permissions only take effect once it expires and is refreshed,
+// which is why authentication tokens are kept short-lived.
+func (app *application) newSignedToken(user *data.User, sessionID int64) (*data.Token, error) {
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	expiry := now.Add(app.config.tokens.authenticationTTL)
+	claims := tokenClaims{
+		Subject:     strconv.FormatInt(user.ID, 10),
+		SessionID:   sessionID,
+		IssuedAt:    now.Unix(),
+		Expiry:      expiry.Unix(),
+		Activated:   user.Activated,
+		Permissions: permissions,
+	}
+	plaintext, err := app.jwtKeys.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+	return &data.Token{Plaintext: plaintext, UserID: user.ID, Expiry: time.Unix(expiry.Unix(), 0), Scope: data.ScopeAuthentication}, nil
+}
+
+// The verifySignedToken() method checks a signed authentication token and returns the
+// user it was issued to, along with its claims. Only the user's id and activation status
+// are known; any other details need to be read from the database.
+func (app *application) verifySignedToken(token string) (*data.User, *tokenClaims, error) {
+	var claims tokenClaims
+	err := app.jwtKeys.Verify(token, &claims)
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || id < 1 {
+		return nil, nil, data.ErrRecordNotFound
+	}
+	return &data.User{ID: id, Activated: claims.Activated}, &claims, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"github.com/fara/fakeauto/internal/data"
+	"github.com/fara/fakeauto/internal/validator"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The loginPolicy() method returns the throttling policy for failed sign in attempts
+// for accounts or for IP addresses. IP addresses get a higher threshold, since many
+// users can share one.
+func (app *application) loginPolicy(kind string) data.LoginPolicy {
+	policy := data.LoginPolicy{
+		MaxFailures: app.config.login.maxFailures,
+		BaseDelay:   app.config.login.baseDelay,
+		Lockout:     app.config.login.lockout,
+	}
+	if kind == data.ThrottleIP {
+		policy.MaxFailures = app.config.login.ipMaxFailures
+	}
+	return policy
+}
+
+// The loginSubjects() method returns the subjects the sign in attempts in a request are
+// counted against: the account, then the client's IP address. The order matters, since
+// the throttles are locked in this order when an attempt is reserved.
+func (app *application) loginSubjects(r *http.Request, email string) []data.LoginSubject {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return []data.LoginSubject{
+		{Kind: data.ThrottleAccount, Subject: strings.ToLower(email), Policy: app.loginPolicy(data.ThrottleAccount)},
+		{Kind: data.ThrottleIP, Subject: ip, Policy: app.loginPolicy(data.ThrottleIP)},
+	}
+}
+
+// The reserveLoginAttempt() method must be called before checking a password or code
+// for the account with the given email address. It returns how long the client must
+// wait if there have been too many failed attempts for the account or from the client's
+// IP address recently. Otherwise the attempt is counted up front, so that parallel
+// requests can't all get past the check before any of them has failed, and the caller
+// must then finish it with recordLoginFailure(), releaseLoginAttempt() or
+// resetLoginFailures().
+func (app *application) reserveLoginAttempt(r *http.Request, email string) (time.Duration, error) {
+	return app.models.Logins.Reserve(app.loginSubjects(r, email))
+}
+
+// The recordLoginFailure() method records that a reserved attempt to sign in to the
+// account with the given email address failed. If this locks out the account, and the
+// account exists, the user is sent an email letting them know.
+func (app *application) recordLoginFailure(r *http.Request, email string, user *data.User) error {
+	for _, s := range app.loginSubjects(r, email) {
+		throttle, locked, err := app.models.Logins.RecordFailure(s.Kind, s.Subject, s.Policy)
+		if err != nil {
+			return err
+		}
+		if locked && s.Kind == data.ThrottleAccount && user != nil {
+			app.background(func() {
+				data := map[string]any{
+					"lockedUntil": throttle.LockedUntil.Format(time.RFC1123),
+				}
+				err := app.mailer.Send(user.Email, "account_locked.tmpl", data)
+				if err != nil {
+					app.logger.PrintError(err, nil)
+				}
+			})
+		}
+	}
+	return nil
+}
+
+// The releaseLoginAttempt() method gives back a reserved attempt whose credentials were
+// right but which didn't sign the user in, such as when a second factor is still needed.
+func (app *application) releaseLoginAttempt(r *http.Request, email string) error {
+	for _, s := range app.loginSubjects(r, email) {
+		err := app.models.Logins.Release(s.Kind, s.Subject)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The resetLoginFailures() method forgets the failed attempts to sign in to an account
+// once the user has signed in successfully. The counter for the client's IP address
+// only has the reserved attempt given back, since otherwise an attacker could clear it
+// by signing in to an account of their own between guesses.
+func (app *application) resetLoginFailures(r *http.Request, email string) error {
+	subjects := app.loginSubjects(r, email)
+	err := app.models.Logins.Reset(subjects[0].Kind, subjects[0].Subject)
+	if err != nil {
+		return err
+	}
+	return app.models.Logins.Release(subjects[1].Kind, subjects[1].Subject)
+}
+
+// The checkPassword() method checks the password a signed in user has sent to confirm a
+// sensitive change, such as deleting their account. Wrong passwords are throttled just
+// like at sign in, so someone who has got hold of a session can't guess the password
+// without limit. If the client has to wait, retryAfter is how long, and the password
+// isn't checked at all.
+func (app *application) checkPassword(r *http.Request, user *data.User, password string) (match bool, retryAfter time.Duration, err error) {
+	retryAfter, err = app.reserveLoginAttempt(r, user.Email)
+	if err != nil || retryAfter > 0 {
+		return false, retryAfter, err
+	}
+	match, err = user.Password.Matches(password)
+	if err != nil {
+		return false, 0, err
+	}
+	if !match {
+		return false, 0, app.recordLoginFailure(r, user.Email, user)
+	}
+	return true, 0, app.resetLoginFailures(r, user.Email)
+}
+
+// The listLoginThrottlesHandler() shows administrators the accounts and IP addresses
+// which are locked out or have recently failed to sign in.
+func (app *application) listLoginThrottlesHandler(w http.ResponseWriter, r *http.Request) {
+	throttles, err := app.models.Logins.GetActive(app.config.login.lockout)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"lockouts": throttles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteLoginThrottleHandler() lets an administrator lift the lockout on an account
+// or IP address and clear its failed attempts.
+func (app *application) deleteLoginThrottleHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Kind    string `json:"kind"`
+		Subject string `json:"subject"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(validator.PermittedValue(input.Kind, data.ThrottleAccount, data.ThrottleIP), "kind", "invalid kind")
+	v.Check(input.Subject != "", "subject", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	if input.Kind == data.ThrottleAccount {
+		input.Subject = strings.ToLower(input.Subject)
+	}
+	err = app.models.Logins.Reset(input.Kind, input.Subject)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "lockout successfully cleared"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
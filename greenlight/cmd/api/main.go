@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"flag"
+	"fmt"
 	_ "github.com/rs/cors"
 	"os"
 	"sync"
@@ -13,6 +14,7 @@ import (
 	// library.
 	"github.com/fara/fakeauto/internal/data"
 	"github.com/fara/fakeauto/internal/jsonlog"
+	"github.com/fara/fakeauto/internal/jwt"
 	"github.com/fara/fakeauto/internal/mailer"
 	_ "github.com/lib/pq"
 )
@@ -74,6 +76,30 @@ type config struct {
 		password string
 		sender   string
 	}
+	// Lifetimes of the tokens handed out when a user signs in. Authentication tokens are
+	// short-lived, and are renewed using the much longer-lived refresh token.
+	// The format can be "opaque", for random tokens looked up in the database, or
+	// "jwt", for signed tokens which are verified using jwtKeys (see jwt.ParseKeySet()).
+	tokens struct {
+		authenticationTTL time.Duration
+		refreshTTL        time.Duration
+		format            string
+		jwtKeys           string
+		jwtSigningKey     string
+	}
+	// Throttling of failed sign in attempts, with separate thresholds for accounts and
+	// IP addresses (see data.LoginPolicy).
+	login struct {
+		maxFailures   int
+		ipMaxFailures int
+		baseDelay     time.Duration
+		lockout       time.Duration
+	}
+	// How long a user's permissions are cached in memory (see permissionCache). This is
+	// also the longest a permission revoked by another instance can still be used.
+	permissions struct {
+		cacheTTL time.Duration
+	}
 }
 
 type application struct {
@@ -81,6 +107,11 @@ type application struct {
 	logger *jsonlog.Logger // new customized logger
 	models data.Models     // hold new models in app
 	mailer mailer.Mailer   // use ower mailer from mailer.go
+	// keys for signing and verifying authentication tokens, or nil if opaque tokens are
+	// used
+	jwtKeys *jwt.KeySet
+	// cache of the permissions of recently seen users
+	permissions *permissionCache
 	// used to wait for a collection of goroutines to finish their work
 	wg sync.WaitGroup
 }
@@ -116,11 +147,39 @@ func main() {
 	flag.StringVar(&cfg.smtp.password, "smtp-password", "Aitu2021!", "SMTP password")
 	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "211374@astanait.edu.kz", "SMTP sender")
 
+	flag.DurationVar(&cfg.tokens.authenticationTTL, "token-authentication-ttl", 15*time.Minute, "Authentication token lifetime")
+	flag.DurationVar(&cfg.tokens.refreshTTL, "token-refresh-ttl", 30*24*time.Hour, "Refresh token lifetime")
+	flag.StringVar(&cfg.tokens.format, "token-format", "opaque", "Authentication token format (opaque|jwt)")
+	// $env:JWTKEYS="2024-01:HS256:base64_encoded_secret_here"
+	flag.StringVar(&cfg.tokens.jwtKeys, "token-jwt-keys", os.Getenv("JWTKEYS"), "JWT keys as comma-separated id:algorithm:base64secret entries")
+	flag.StringVar(&cfg.tokens.jwtSigningKey, "token-jwt-signing-key", "", "ID of the JWT key to sign new tokens with (defaults to the first key)")
+
+	flag.IntVar(&cfg.login.maxFailures, "login-max-failures", 5, "Failed sign in attempts before an account is locked out")
+	flag.IntVar(&cfg.login.ipMaxFailures, "login-ip-max-failures", 20, "Failed sign in attempts before an IP address is locked out")
+	flag.DurationVar(&cfg.login.baseDelay, "login-base-delay", time.Second, "Delay after the first failed sign in attempt, doubled after each further failure")
+	flag.DurationVar(&cfg.login.lockout, "login-lockout", 15*time.Minute, "Sign in lockout duration")
+
+	flag.DurationVar(&cfg.permissions.cacheTTL, "permissions-cache-ttl", 30*time.Second, "How long user permissions are cached for (0 disables the cache)")
+
 	flag.Parse()
 	// Using new json oriented logger
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 	// logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
 
+	// Load the JWT keys if signed authentication tokens are in use.
+	var jwtKeys *jwt.KeySet
+	switch cfg.tokens.format {
+	case "opaque":
+	case "jwt":
+		var err error
+		jwtKeys, err = jwt.ParseKeySet(cfg.tokens.jwtKeys, cfg.tokens.jwtSigningKey)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	default:
+		logger.PrintFatal(fmt.Errorf("invalid token format %q", cfg.tokens.format), nil)
+	}
+
 	db, err := openDB(cfg)
 	if err != nil {
 		logger.PrintFatal(err, nil) // calling PrintFatal function if there is an error with db server connection
@@ -129,13 +188,16 @@ func main() {
 	defer db.Close()
 	logger.PrintInfo("database connection pool established", nil) // printing custom info if db server connection is established
 
+	models := data.NewModels(db) // data.NewModels() function to initialize a Models struct
 	app := &application{
 		config: cfg,
 		logger: logger,
-		models: data.NewModels(db), // data.NewModels() function to initialize a Models struct
+		models: models,
 		// Initialize a new Mailer instance using the settings from the command line
 		// flags, and add it to the application struct.
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		mailer:      mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		jwtKeys:     jwtKeys,
+		permissions: newPermissionCache(cfg.permissions.cacheTTL, models.Permissions.GetAllForUser),
 	}
 	// new way of declaration of server part
 
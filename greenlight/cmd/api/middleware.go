@@ -105,9 +105,30 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// caches that the response may vary based on the value of the Authorization
 		// header in the request.
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
 		// Retrieve the value of the Authorization header from the request. This will
 		// return the empty string "" if there is no such header found.
 		authorizationHeader := r.Header.Get("Authorization")
+		// Machine clients authenticate with an API key instead, sent either in the
+		// X-API-Key header or as "ApiKey <key>" in the Authorization header. Sending an
+		// API key together with a bearer token is ambiguous, so we reject it.
+		apiKey := r.Header.Get("X-API-Key")
+		if strings.HasPrefix(authorizationHeader, "ApiKey ") {
+			if apiKey != "" {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+			apiKey = strings.TrimPrefix(authorizationHeader, "ApiKey ")
+			authorizationHeader = ""
+		}
+		if apiKey != "" {
+			if authorizationHeader != "" {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+			app.authenticateAPIKey(w, r, next, apiKey)
+			return
+		}
 		// If there is no Authorization header found, use the contextSetUser() helper
 		// that we just made to add the AnonymousUser to the request context. Then we
 		// call the next handler in the chain and return without executing any of the
@@ -129,6 +150,22 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 		// Extract the actual authentication token from the header parts.
 		token := headerParts[1]
+		// In JWT mode, a token made up of three dot-separated parts is a signed token,
+		// which we can verify without going to the database. The user's permissions are
+		// taken from the token too. Opaque tokens are still accepted, so that sessions
+		// started before JWT mode was turned on carry on working.
+		if app.jwtKeys != nil && strings.Count(token, ".") == 2 {
+			user, claims, err := app.verifySignedToken(token)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+			r = app.contextSetUser(r, user)
+			r = app.contextSetSessionID(r, claims.SessionID)
+			r = app.contextSetPermissions(r, claims.Permissions)
+			next.ServeHTTP(w, r)
+			return
+		}
 		// Validate the token to make sure it is in a sensible format.
 		v := validator.New()
 		// If the token isn't valid, use the invalidAuthenticationTokenResponse()
@@ -153,14 +190,65 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		// Deactivating a user revokes their tokens, but check anyway in case one was
+		// issued in the meantime.
+		if user.DeactivatedAt != nil {
+			app.deactivatedAccountResponse(w, r)
+			return
+		}
+
+		// Record that the token has been used, so it shows up in the user's list of
+		// sessions with its last-used time.
+		err = app.models.Tokens.Touch(data.ScopeAuthentication, token)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
 		// Call the contextSetUser() helper to add the user information to the request
-		// context.
+		// context, along with the token itself.
 		r = app.contextSetUser(r, user)
+		r = app.contextSetToken(r, token)
 		// Call the next handler in the chain.
 		next.ServeHTTP(w, r)
 	})
 }
 
+// The authenticateAPIKey() method completes the authenticate() middleware for a request
+// made with an API key. The permissions in the request context are those of the key,
+// rather than all of the user's.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, plaintext string) {
+	v := validator.New()
+	if data.ValidateAPIKeyPlaintext(v, plaintext); !v.Valid() {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+	user, key, err := app.models.APIKeys.GetForKey(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// A deactivated user's keys are kept, but mustn't work until they are reactivated.
+	if user.DeactivatedAt != nil {
+		app.deactivatedAccountResponse(w, r)
+		return
+	}
+	err = app.models.APIKeys.Touch(key.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	r = app.contextSetUser(r, user)
+	r = app.contextSetPermissions(r, key.Permissions)
+	r = app.contextSetAPIKey(r, key)
+	next.ServeHTTP(w, r)
+}
+
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -188,12 +276,36 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// The userPermissions() method returns the permissions of the user making the request,
+// either from the signed token or API key the request was made with, which may narrow
+// them down, or from the permission cache.
+func (app *application) userPermissions(r *http.Request) (data.Permissions, error) {
+	if permissions, ok := app.contextGetPermissions(r); ok {
+		return permissions, nil
+	}
+	return app.permissions.get(app.contextGetUser(r).ID)
+}
+
+// The requireSession() middleware checks that a user is authenticated and that the
+// request was made from a session they signed in to, rather than with an API key. It
+// guards actions, like creating API keys or changing the user's password, which a leaked
+// key mustn't be able to carry out. Routes which also need an activated user wrap it in
+// requireActivatedUser().
+func (app *application) requireSession(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.sessionRequiredResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return app.requireAuthenticatedUser(fn)
+}
+
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		// Retrieve the user from the request context.
-		user := app.contextGetUser(r)
 		// Get the slice of permissions for the user.
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+		permissions, err := app.userPermissions(r)
 		if err != nil {
 			app.serverErrorResponse(w, r, err)
 			return
@@ -4,58 +4,44 @@ import (
 	"errors"
 	"fmt"
 	"github.com/fara/fakeauto/internal/data"
+	"github.com/fara/fakeauto/internal/jsonpatch"
 	"github.com/fara/fakeauto/internal/validator"
 	"net/http"
+	"strconv"
 )
 
-func (app *application) createMotorbikeHandler(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		Name         string  `json:"name"`
-		Horsepower   float64 `json:"horsepower"`
-		Type         string  `json:"type"`
-		Weight       float64 `json:"weight"`
-		ThirdPlace   bool    `json:"third_place"`
-		Cylinders    int64   `json:"cylinders"`
-		Acceleration float64 `json:"acceleration"`
-		Displacement float64 `json:"displacement"`
-		Origin       string  `json:"origin"`
-	}
-
-	err := app.readJSON(w, r, &input)
-	if err != nil {
-		app.errorResponse(w, r, http.StatusBadRequest, err.Error())
-	}
-
-	v := validator.New()
-
-	v.Check(input.Name != "", "name", "must be provided")
-	v.Check(len(input.Name) <= 500, "name", "must not be more than 500 bytes long")
-
-	v.Check(input.Type != "", "type", "must be provided")
-
-	v.Check(input.Horsepower != 0, "horsepower", "must be provided")
-	v.Check(input.Horsepower <= 2000, "horsepower", "must be less than 2000")
-
-	v.Check(input.Weight != 0, "weight", "must be provided")
-	v.Check(input.Weight <= 1000, "weight", "must be less than 1000kg")
-
-	v.Check(input.Cylinders != 0, "cylinders", "must be provided")
-	v.Check(input.Cylinders%2 == 0, "cylinders", "must be 2, 4 etc...")
-
-	v.Check(input.Acceleration != 0, "acceleration", "must be provided")
-
-	v.Check(input.Displacement != 0, "displacement", "must be provided")
-
-	v.Check(input.Origin != "", "origin", "must be provided")
-	v.Check(len(input.Origin) <= 50, "origin", "must not be more than 50 bytes long")
+// The numeric columns which can be filtered by range ("horsepower_min=150"), and the
+// columns which can be filtered by a list of values ("cylinders=4,6"), on the motorbikes
+// listing, facets and export endpoints, the fields which can be requested as a sparse
+// fieldset ("fields=id,name,horsepower"), and the columns which can be sorted on.
+var (
+	motorbikeSortSafelist = data.SortSafelist("id", "name", "type", "horsepower", "weight", "third_place",
+		"cylinders", "acceleration", "displacement", "origin", "created_at")
+	motorbikeFieldSafelist = []string{"id", "name", "horsepower", "type", "weight", "third_place", "cylinders",
+		"acceleration", "displacement", "origin", "version"}
+	motorbikeRangeSafelist = []string{"horsepower", "weight", "cylinders", "acceleration", "displacement"}
+	motorbikeValueSafelist = []string{"type", "cylinders", "origin"}
+	// The trash listing can also be sorted on, and return, the time each motorbike was deleted.
+	motorbikeTrashSortSafelist  = append(data.SortSafelist("deleted_at"), motorbikeSortSafelist...)
+	motorbikeTrashFieldSafelist = append([]string{"deleted_at"}, motorbikeFieldSafelist...)
+)
 
-	if !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
-		return
-	}
-	fmt.Fprintf(w, "%+v\n", input)
+// A motorbikeInput holds the fields of a motorbike supplied by the client when creating
+// one, either through createMotorbikeHandler or as a row of a bulk import.
+type motorbikeInput struct {
+	Name         string  `json:"name"`
+	Horsepower   float64 `json:"horsepower"`
+	Type         string  `json:"type"`
+	Weight       float64 `json:"weight"`
+	ThirdPlace   bool    `json:"third_place"`
+	Cylinders    int64   `json:"cylinders"`
+	Acceleration float64 `json:"acceleration"`
+	Displacement float64 `json:"displacement"`
+	Origin       string  `json:"origin"`
+}
 
-	motorbike := &data.Motorbike{
+func (input motorbikeInput) motorbike() *data.Motorbike {
+	return &data.Motorbike{
 		Name:         input.Name,
 		Horsepower:   input.Horsepower,
 		Type:         input.Type,
@@ -66,8 +52,26 @@ func (app *application) createMotorbikeHandler(w http.ResponseWriter, r *http.Re
 		Displacement: input.Displacement,
 		Origin:       input.Origin,
 	}
+}
 
-	err = app.models.MotorBikes.Insert(motorbike)
+func (app *application) createMotorbikeHandler(w http.ResponseWriter, r *http.Request) {
+	var input motorbikeInput
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	motorbike := input.motorbike()
+
+	v := validator.New()
+	if data.ValidateMotorbike(v, motorbike); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.MotorBikes.Insert(motorbike, app.contextGetUser(r).ID)
 
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -88,9 +92,28 @@ func (app *application) showMotorbikeHandler(w http.ResponseWriter, r *http.Requ
 	id, err := app.readIDParam(r)
 	if err != nil {
 		app.notFoundResponse(w, r)
+		return
 	}
 
-	motorbike, err := app.models.MotorBikes.Get(id)
+	v := validator.New()
+	qs := r.URL.Query()
+	fields := app.readCSV(qs, "fields", nil)
+	data.ValidateFields(v, fields, motorbikeFieldSafelist)
+	// An as_of_version parameter asks for the motorbike as it was at a past version, which
+	// is rebuilt from its history.
+	asOfVersion := app.readInt(qs, "as_of_version", 0, v)
+	v.Check(asOfVersion > 0 || !qs.Has("as_of_version"), "as_of_version", "must be greater than zero")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	var motorbike *data.Motorbike
+	if asOfVersion > 0 {
+		motorbike, err = app.models.MotorBikes.GetVersion(id, int32(asOfVersion))
+	} else {
+		motorbike, err = app.models.MotorBikes.Get(id, fields...)
+	}
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -100,9 +123,22 @@ func (app *application) showMotorbikeHandler(w http.ResponseWriter, r *http.Requ
 		}
 		return
 	}
-	// Encode the struct to JSON and send it as the HTTP response.
-	// using envelope
-	err = app.writeJSON(w, http.StatusOK, envelope{"motorbike": motorbike}, nil)
+	// Send the ETag for this version and fieldset, and if the client already holds it
+	// then there's no need to send the record again.
+	headers := make(http.Header)
+	headers.Set("ETag", etag(motorbike.ID, motorbike.Version, fields...))
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, headers.Get("ETag"), true) {
+		w.Header().Set("ETag", headers.Get("ETag"))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	// Encode the struct to JSON and send it as the HTTP response, trimmed down to the
+	// requested fields if the client asked for a sparse fieldset.
+	var body any = motorbike
+	if fields != nil {
+		body = motorbike.Project(fields)
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"motorbike": body}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -126,110 +162,207 @@ func (app *application) updateMotorbikeHandler(w http.ResponseWriter, r *http.Re
 		return
 
 	}
-	// Use pointers for the Title, Year and Runtime fields.
-	var input struct {
-		Name         *string  `json:"name"`
-		Horsepower   *float64 `json:"horsepower"`
-		Type         *string  `json:"type"`
-		Weight       *float64 `json:"weight"`
-		ThirdPlace   *bool    `json:"third_place"`
-		Cylinders    *int64   `json:"cylinders"`
-		Acceleration *float64 `json:"acceleration"`
-		Displacement *float64 `json:"displacement"`
-		Origin       *string  `json:"origin"`
+	// Only the owner may edit the motorbike, unless the user may edit any motorbike.
+	if !app.checkOwner(w, r, motorbike.CreatedBy, "motorbikes:write:any") {
+		return
 	}
-	// Decode the JSON as normal.
-	err = app.readJSON(w, r, &input)
+	// Refuse to apply the changes unless the client is editing the version it last
+	// retrieved.
+	if !app.checkIfMatch(w, r, etag(motorbike.ID, motorbike.Version)) {
+		return
+	}
+	// Apply the patch document from the request body to the motorbike. This accepts both
+	// JSON Merge Patch and JSON Patch documents, see readPatch().
+	version := motorbike.Version
+	err = app.readPatch(w, r, motorbike)
 	if err != nil {
-		app.badRequestResponse(w, r, err)
+		switch {
+		case errors.Is(err, errUnsupportedMediaType):
+			app.unsupportedMediaTypeResponse(w, r)
+		case errors.Is(err, jsonpatch.ErrTestFailed):
+			app.patchTestFailedResponse(w, r, err)
+		case errors.Is(err, jsonpatch.ErrPathNotFound):
+			app.unprocessablePatchResponse(w, r, err)
+		default:
+			app.badRequestResponse(w, r, err)
+		}
 		return
 	}
 
-	if input.Name != nil {
-		motorbike.Name = *input.Name
-	}
-	// We also do the same for the other fields in the input struct.
-	if input.Horsepower != nil {
-		motorbike.Horsepower = *input.Horsepower
-	}
-	if input.Type != nil {
-		motorbike.Type = *input.Type
+	v := validator.New()
+	// The id and version are managed by the database, so a patch mustn't change them.
+	v.Check(motorbike.ID == id, "id", "must not be changed")
+	v.Check(motorbike.Version == version, "version", "must not be changed")
+	v.Check(motorbike.DeletedAt == nil, "deleted_at", "must not be changed")
+	if data.ValidateMotorbike(v, motorbike); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
 	}
-	if input.Weight != nil {
-		motorbike.Weight = *input.Weight // Note that we don't need to dereference a slice.
+
+	err = app.models.MotorBikes.Update(motorbike, app.contextGetUser(r).ID)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
 	}
-	// We also do the same for the other fields in the input struct.
-	if input.ThirdPlace != nil {
-		motorbike.ThirdPlace = *input.ThirdPlace
+	// Send the ETag of the new version so the client can make further changes.
+	headers := make(http.Header)
+	headers.Set("ETag", etag(motorbike.ID, motorbike.Version))
+	err = app.writeJSON(w, http.StatusOK, envelope{"motorbike": motorbike}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
 	}
-	if input.Cylinders != nil {
-		motorbike.Cylinders = *input.Cylinders
+
+}
+
+func (app *application) deleteMotorbikeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
 	}
-	if input.Acceleration != nil {
-		motorbike.Acceleration = *input.Acceleration // Note that we don't need to dereference a slice.
+
+	// Look up the current version and owner first, so we can tell a missing record from
+	// a stale If-Match header.
+	motorbike, err := app.models.MotorBikes.Get(id, "version", "created_by")
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
 	}
-	if input.Displacement != nil {
-		motorbike.Displacement = *input.Displacement
+	if !app.checkOwner(w, r, motorbike.CreatedBy, "motorbikes:delete:any") {
+		return
 	}
-	if input.Origin != nil {
-		motorbike.Origin = *input.Origin // Note that we don't need to dereference a slice.
+	if !app.checkIfMatch(w, r, etag(motorbike.ID, motorbike.Version)) {
+		return
 	}
 
-	v := validator.New()
-
-	v.Check(motorbike.Name != "", "name", "must be provided")
-	v.Check(len(motorbike.Name) <= 500, "name", "must not be more than 500 bytes long")
-
-	v.Check(motorbike.Horsepower != 0, "horsepower", "must be provided")
-	v.Check(motorbike.Horsepower <= 2000, "horsepower", "must be less than 2000")
-
-	v.Check(motorbike.Type != "", "type", "must be provided")
-	v.Check(len(motorbike.Type) <= 50, "type", "must not be more than 50 bytes long")
+	err = app.models.MotorBikes.Delete(motorbike.ID, motorbike.Version, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
 
-	v.Check(motorbike.Weight != 0, "weight", "must be provided")
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "motorbike successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
 
-	v.Check(motorbike.Cylinders != 0, "cylinders", "must be provided")
-	v.Check(motorbike.Cylinders%2 == 0, "cylinders", "must be 2, 4 etc...")
+}
 
-	v.Check(motorbike.Acceleration != 0, "acceleration", "must be provided")
+func (app *application) restoreMotorbikeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
 
-	v.Check(motorbike.Displacement != 0, "displacement", "must be provided")
+	// Only the owner may restore the motorbike, unless the user may delete any motorbike.
+	createdBy, err := app.models.MotorBikes.GetOwner(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !app.checkOwner(w, r, createdBy, "motorbikes:delete:any") {
+		return
+	}
 
-	v.Check(motorbike.Origin != "", "origin", "must be provided")
-	v.Check(len(motorbike.Origin) <= 50, "origin", "must not be more than 50 bytes long")
+	err = app.models.MotorBikes.Restore(id, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
 
-	if !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
+	// Send back the restored motorbike along with the ETag of its new version.
+	motorbike, err := app.models.MotorBikes.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
-	fmt.Fprintf(w, "%+v\n", input)
+	headers := make(http.Header)
+	headers.Set("ETag", etag(motorbike.ID, motorbike.Version))
+	err = app.writeJSON(w, http.StatusOK, envelope{"motorbike": motorbike}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
 
-	err = app.models.MotorBikes.Update(motorbike)
+func (app *application) purgeMotorbikeHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
 
+	// Only motorbikes which are already in the trash can be purged, so there's no need for an
+	// If-Match header here: nobody can edit a deleted record in the meantime.
+	err = app.models.MotorBikes.Purge(id, app.contextGetUser(r).ID)
 	if err != nil {
 		switch {
-		case errors.Is(err, data.ErrEditConflict):
-			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
-	err = app.writeJSON(w, http.StatusOK, envelope{"motorbike": motorbike}, nil)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "motorbike successfully purged"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
-
 }
 
-func (app *application) deleteMotorbikeHandler(w http.ResponseWriter, r *http.Request) {
+func (app *application) motorbikeHistoryHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
 		app.notFoundResponse(w, r)
 		return
 	}
 
-	err = app.models.MotorBikes.Delete(id)
+	v := validator.New()
+	qs := r.URL.Query()
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, v),
+		PageSize:     app.readInt(qs, "page_size", 20, v),
+		Sort:         app.readString(qs, "sort", "id"),
+		SortSafelist: data.HistorySortSafelist,
+	}
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	history, metadata, err := app.models.MotorBikes.History(id, filters)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -240,39 +373,190 @@ func (app *application) deleteMotorbikeHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "motorbike successfully deleted"}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"history": history, "metadata": metadata}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
-
 }
 
 func (app *application) listMotorbikesHandler(w http.ResponseWriter, r *http.Request) {
+	app.listMotorbikes(w, r, false, 0)
+}
+
+func (app *application) trashMotorbikesHandler(w http.ResponseWriter, r *http.Request) {
+	app.listMotorbikes(w, r, true, 0)
+}
+
+// The listCurrentUserMotorbikesHandler() lists the motorbikes created by the caller, taking the
+// same parameters as listMotorbikesHandler().
+func (app *application) listCurrentUserMotorbikesHandler(w http.ResponseWriter, r *http.Request) {
+	app.listMotorbikes(w, r, false, app.contextGetUser(r).ID)
+}
+
+// The listMotorbikes() helper serves both the regular listing and the trash, which accept the
+// same query string parameters and only differ in which motorbikes they return. A non-zero
+// createdBy only lists the motorbikes created by that user.
+func (app *application) listMotorbikes(w http.ResponseWriter, r *http.Request, deleted bool, createdBy int64) {
+	sortSafelist, fieldSafelist := motorbikeSortSafelist, motorbikeFieldSafelist
+	if deleted {
+		sortSafelist, fieldSafelist = motorbikeTrashSortSafelist, motorbikeTrashFieldSafelist
+	}
+
 	var input struct {
-		Name string
+		data.SearchFilters
 		data.Filters
 	}
 	v := validator.New()
 	qs := r.URL.Query()
-	input.Name = app.readString(qs, "name", "")
+	// Read the name term together with the range and value filters, e.g.
+	// ?horsepower_min=150&horsepower_max=300&cylinders=4,6
+	input.SearchFilters = app.readSearchFilters(qs, motorbikeRangeSafelist, motorbikeValueSafelist, v)
+	input.SearchFilters.Deleted = deleted
+	input.SearchFilters.CreatedBy = createdBy
 
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	// An opaque cursor from a previous response's next_cursor or prev_cursor switches
+	// to keyset paging, which stays consistent while the inventory changes.
+	input.Filters.Cursor = app.readString(qs, "cursor", "")
+	fields := app.readCSV(qs, "fields", nil)
+	data.ValidateFields(v, fields, fieldSafelist)
 	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafelist = []string{"id", "name", "type", "-id", "-name", "-type"}
+	input.Filters.SortSafelist = sortSafelist
+	input.Filters.Record = &data.Motorbike{}
+	data.ValidateSearchFilters(v, input.SearchFilters)
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 	// Accept the metadata struct as a return value.
-	motorbikes, metadata, err := app.models.MotorBikes.GetAll(input.Name, input.Filters)
+	motorbikes, metadata, err := app.models.MotorBikes.GetAll(input.SearchFilters, input.Filters, fields...)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	var body any = motorbikes
+	if fields != nil {
+		body = projectAll(motorbikes, fields)
+	}
 	// Include the metadata in the response envelope.
-	err = app.writeJSON(w, http.StatusOK, envelope{"motorbikes": motorbikes, "metadata": metadata}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"motorbikes": body, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) motorbikeFacetsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	// Facets honour exactly the same filters as the listing endpoint.
+	search := app.readSearchFilters(qs, motorbikeRangeSafelist, motorbikeValueSafelist, v)
+	if data.ValidateSearchFilters(v, search); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	facets, err := app.models.MotorBikes.Facets(search)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"facets": facets}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) importMotorbikesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	dryRun, err := strconv.ParseBool(app.readString(r.URL.Query(), "dry_run", "false"))
+	if err != nil {
+		v.AddError("dry_run", "must be a boolean value")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	inputs, rowErrors, warnings, err := readImport[motorbikeInput](w, r)
+	if err != nil {
+		switch {
+		case errors.Is(err, errUnsupportedMediaType):
+			app.unsupportedMediaTypeResponse(w, r)
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+
+	// Validate every row with the same rules as createMotorbikeHandler, collecting the
+	// valid motorbikes along with the position of their row in the report.
+	report := importReport{DryRun: dryRun, Total: len(inputs), Warnings: warnings}
+	var motorbikes []*data.Motorbike
+	var reportIndex []int
+	for i, input := range inputs {
+		row := importRow{Row: i + 1, Errors: rowErrors[i]}
+		if row.Errors == nil {
+			motorbike := input.motorbike()
+			v := validator.New()
+			if data.ValidateMotorbike(v, motorbike); v.Valid() {
+				motorbikes = append(motorbikes, motorbike)
+				reportIndex = append(reportIndex, i)
+			} else {
+				row.Errors = v.Errors
+			}
+		}
+		report.Rows = append(report.Rows, row)
+	}
+	report.Accepted = len(motorbikes)
+	report.Rejected = report.Total - report.Accepted
+
+	if !dryRun && len(motorbikes) > 0 {
+		err = app.models.MotorBikes.InsertMany(motorbikes, app.contextGetUser(r).ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		for i, motorbike := range motorbikes {
+			report.Rows[reportIndex[i]].ID = motorbike.ID
+		}
+	}
+
+	app.writeImportReport(w, r, report)
+}
+
+func (app *application) exportMotorbikesHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	// Exports take the same filters and sort keys as the listing endpoint, but aren't
+	// paged. The fields parameter picks the exported columns.
+	search := app.readSearchFilters(qs, motorbikeRangeSafelist, motorbikeValueSafelist, v)
+	filters := data.Filters{
+		Sort:         app.readString(qs, "sort", "id"),
+		SortSafelist: motorbikeSortSafelist,
+	}
+	fields := app.readCSV(qs, "fields", motorbikeFieldSafelist)
+	data.ValidateSearchFilters(v, search)
+	data.ValidateSort(v, filters)
+	if data.ValidateFields(v, fields, motorbikeFieldSafelist); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	format, ok := negotiateExportFormat(r.Header.Get("Accept"))
+	if !ok {
+		app.notAcceptableResponse(w, r, exportFormats)
+		return
+	}
+
+	// Use the request context rather than a fixed timeout, so the export runs for as
+	// long as the client keeps reading and stops if it goes away. The exporter keeps
+	// pushing back the server's write deadline for the same reason.
+	e := newExporter(w, format, "motorbikes", fields)
+	err := app.models.MotorBikes.Export(r.Context(), search, filters, func(motorbike *data.Motorbike) error {
+		return e.write(motorbike)
+	}, fields...)
+	if err == nil {
+		err = e.finish()
+	}
+	if err != nil {
+		app.exportFailed(w, r, e, err)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"github.com/fara/fakeauto/internal/data"
+	"github.com/fara/fakeauto/internal/jsonpatch"
+	"github.com/fara/fakeauto/internal/validator"
+	"net/http"
+)
+
+// The listPermissionsHandler() lists every permission code which can be granted to a
+// user or included in a role.
+func (app *application) listPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	permissions, err := app.models.Permissions.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The checkPermissionCodes() method adds a validation error under key if any of codes
+// isn't a known permission code. Unknown codes would otherwise be silently ignored by
+// the data layer.
+func (app *application) checkPermissionCodes(v *validator.Validator, key string, codes data.Permissions) error {
+	known, err := app.models.Permissions.GetAll()
+	if err != nil {
+		return err
+	}
+	for _, code := range codes {
+		if !validator.PermittedValue(code, known...) {
+			v.AddError(key, "must only contain known permission codes")
+			break
+		}
+	}
+	return nil
+}
+
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string           `json:"name"`
+		Description string           `json:"description"`
+		Permissions data.Permissions `json:"permissions"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	role := &data.Role{
+		Name:        input.Name,
+		Description: input.Description,
+		Permissions: input.Permissions,
+	}
+	v := validator.New()
+	data.ValidateRole(v, role)
+	err = app.checkPermissionCodes(v, "permissions", role.Permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Roles.Insert(role)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRoleName):
+			v.AddError("name", "a role with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusCreated, envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readRoleParam() helper reads the id parameter and looks up the role it names,
+// sending a 404 Not Found response and returning nil if there is no such role.
+func (app *application) readRoleParam(w http.ResponseWriter, r *http.Request) *data.Role {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil
+	}
+	role, err := app.models.Roles.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return role
+}
+
+func (app *application) showRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role := app.readRoleParam(w, r)
+	if role == nil {
+		return
+	}
+	err := app.writeJSON(w, http.StatusOK, envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The updateRoleHandler() edits a role's name, description or permissions. Like
+// updateCarHandler(), it accepts both JSON Merge Patch and JSON Patch documents, so a
+// single code can be added to a role with a JSON Patch "add" to /permissions/-.
+func (app *application) updateRoleHandler(w http.ResponseWriter, r *http.Request) {
+	role := app.readRoleParam(w, r)
+	if role == nil {
+		return
+	}
+	id, version, createdAt := role.ID, role.Version, role.CreatedAt
+	err := app.readPatch(w, r, role)
+	if err != nil {
+		switch {
+		case errors.Is(err, errUnsupportedMediaType):
+			app.unsupportedMediaTypeResponse(w, r)
+		case errors.Is(err, jsonpatch.ErrTestFailed):
+			app.patchTestFailedResponse(w, r, err)
+		case errors.Is(err, jsonpatch.ErrPathNotFound):
+			app.unprocessablePatchResponse(w, r, err)
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return
+	}
+
+	v := validator.New()
+	// The id, version and creation time are managed by the database, so a patch mustn't
+	// change them.
+	v.Check(role.ID == id, "id", "must not be changed")
+	v.Check(role.Version == version, "version", "must not be changed")
+	v.Check(role.CreatedAt.Equal(createdAt), "created_at", "must not be changed")
+	data.ValidateRole(v, role)
+	err = app.checkPermissionCodes(v, "permissions", role.Permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	err = app.models.Roles.Update(role)
+	// The role's permissions may have changed for any number of users, so forget them
+	// all. This is done even if the update failed, since it's cheap and safe.
+	app.permissions.invalidateAll()
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRoleName):
+			v.AddError("name", "a role with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteRoleHandler() deletes a role, taking its permissions away from every user
+// who had it, except for those they also hold directly or through another role.
+func (app *application) deleteRoleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	err = app.models.Roles.Delete(id)
+	app.permissions.invalidateAll()
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "role successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The writeUserPermissions() method sends a user's roles, the permissions granted to
+// them directly, and all of the permissions they end up holding.
+func (app *application) writeUserPermissions(w http.ResponseWriter, r *http.Request, userID int64) {
+	roles, err := app.models.Roles.GetAllForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	direct, err := app.models.Permissions.GetDirectForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	permissions, err := app.models.Permissions.GetAllForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	env := envelope{
+		"roles":              roles,
+		"direct_permissions": direct,
+		"permissions":        permissions,
+	}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+// The grantUserPermissionsHandler() grants roles and permissions to a user, and the
+// revokeUserPermissionsHandler() takes them away again. Both read a body like
+// {"roles": [1, 2], "permissions": ["cars:read"]}, where either list may be left out.
+// Revoking a permission only removes the direct grant, so the user keeps it if one of
+// their roles includes it; the response shows what they are left with.
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeUserPermissions(w, r, true)
+}
+
+func (app *application) revokeUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeUserPermissions(w, r, false)
+}
+
+func (app *application) changeUserPermissions(w http.ResponseWriter, r *http.Request, grant bool) {
+	user := app.readUserParam(w, r)
+	if user == nil {
+		return
+	}
+	var input struct {
+		Roles       []int64          `json:"roles"`
+		Permissions data.Permissions `json:"permissions"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(len(input.Roles) > 0 || len(input.Permissions) > 0, "permissions", "must provide at least one role or permission")
+	v.Check(validator.Unique(input.Roles), "roles", "must not contain duplicate values")
+	v.Check(validator.Unique(input.Permissions), "permissions", "must not contain duplicate values")
+	if grant {
+		err = app.checkPermissionCodes(v, "permissions", input.Permissions)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		for _, id := range input.Roles {
+			_, err := app.models.Roles.Get(id)
+			if errors.Is(err, data.ErrRecordNotFound) {
+				v.AddError("roles", "must only contain existing role ids")
+				break
+			} else if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Make the change take effect straight away, rather than when the user's cached
+	// permissions expire. This is deferred so that it also happens if only some of the
+	// changes are made.
+	defer app.permissions.invalidate(user.ID)
+	changeRoles, changePermissions := app.models.Roles.RemoveForUser, app.models.Permissions.RemoveForUser
+	if grant {
+		changeRoles, changePermissions = app.models.Roles.AddForUser, app.models.Permissions.AddForUser
+	}
+	if len(input.Roles) > 0 {
+		err = changeRoles(user.ID, input.Roles...)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	if len(input.Permissions) > 0 {
+		err = changePermissions(user.ID, input.Permissions...)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	app.writeUserPermissions(w, r, user.ID)
+}
@@ -14,19 +14,79 @@ func (app *application) routes() http.Handler {
 
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/email", app.confirmEmailChangeHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/me", app.requireAuthenticatedUser(app.showCurrentUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/users/me", app.requireSession(app.updateCurrentUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me", app.requireSession(app.deleteCurrentUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/cars", app.requirePermission("cars:read", app.listCurrentUserCarsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/motorbikes", app.requirePermission("motorbikes:read", app.listCurrentUserMotorbikesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp", app.requireActivatedUser(app.requireSession(app.enrollTOTPHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp/confirm", app.requireActivatedUser(app.requireSession(app.confirmTOTPHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/totp", app.requireActivatedUser(app.requireSession(app.deleteTOTPHandler)))
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/mfa", app.createMFAAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshTokenHandler)
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireAuthenticatedUser(app.deleteAuthenticationTokenHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication/all", app.requireAuthenticatedUser(app.deleteAllAuthenticationTokensHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/tokens", app.requireAuthenticatedUser(app.listTokensHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
 
-	router.HandlerFunc(http.MethodGet, "/v1/cars", app.requirePermission("movies:read", app.listCarsHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/cars", app.requirePermission("movies:write", app.createCarHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/cars/:id", app.requirePermission("movies:read", app.showCarHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/cars/:id", app.requirePermission("movies:write", app.updateCarHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/cars/:id", app.requirePermission("movies:write", app.deleteCarHandler))
-
-	router.HandlerFunc(http.MethodGet, "/v1/motorbikes", app.requirePermission("movies:read", app.listMotorbikesHandler))
-	router.HandlerFunc(http.MethodPost, "/v1/motorbikes", app.requirePermission("movies:write", app.createMotorbikeHandler))
-	router.HandlerFunc(http.MethodGet, "/v1/motorbikes/:id", app.requirePermission("movies:read", app.showMotorbikeHandler))
-	router.HandlerFunc(http.MethodPatch, "/v1/motorbikes/:id", app.requirePermission("movies:write", app.updateMotorbikeHandler))
-	router.HandlerFunc(http.MethodDelete, "/v1/motorbikes/:id", app.requirePermission("movies:write", app.deleteMotorbikeHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePermission("users:admin", app.listUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requirePermission("users:admin", app.showUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id", app.requirePermission("users:admin", app.deleteUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/deactivate", app.requirePermission("users:admin", app.deactivateUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/reactivate", app.requirePermission("users:admin", app.reactivateUserHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/password-reset", app.requirePermission("users:admin", app.forceUserPasswordResetHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/permissions", app.requirePermission("permissions:admin", app.showUserPermissionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/permissions", app.requirePermission("permissions:admin", app.grantUserPermissionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions", app.requirePermission("permissions:admin", app.revokeUserPermissionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/permissions", app.requirePermission("permissions:admin", app.listPermissionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/permissions/cache", app.requirePermission("permissions:admin", app.showPermissionCacheHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles", app.requirePermission("permissions:admin", app.listRolesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/roles", app.requirePermission("permissions:admin", app.createRoleHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles/:id", app.requirePermission("permissions:admin", app.showRoleHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/roles/:id", app.requirePermission("permissions:admin", app.updateRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/roles/:id", app.requirePermission("permissions:admin", app.deleteRoleHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/lockouts", app.requirePermission("users:admin", app.listLoginThrottlesHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/lockouts", app.requirePermission("users:admin", app.deleteLoginThrottleHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/api-keys", app.requireActivatedUser(app.listAPIKeysHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/api-keys", app.requireActivatedUser(app.requireSession(app.createAPIKeyHandler)))
+	router.HandlerFunc(http.MethodDelete, "/v1/api-keys/:id", app.requireActivatedUser(app.requireSession(app.deleteAPIKeyHandler)))
+
+	router.HandlerFunc(http.MethodGet, "/v1/cars", app.requirePermission("cars:read", app.listCarsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/cars", app.requirePermission("cars:write", app.createCarHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/cars/:id", app.routeByID(app.methodNotAllowedResponse, map[string]http.HandlerFunc{
+		"import": app.requirePermission("cars:write", app.importCarsHandler),
+	}))
+	router.HandlerFunc(http.MethodPost, "/v1/cars/:id/restore", app.requirePermission("cars:delete", app.restoreCarHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/cars/:id", app.routeByID(app.requirePermission("cars:read", app.showCarHandler), map[string]http.HandlerFunc{
+		"facets": app.requirePermission("cars:read", app.carFacetsHandler),
+		"export": app.requirePermission("cars:read", app.exportCarsHandler),
+		"trash":  app.requirePermission("cars:read", app.trashCarsHandler),
+	}))
+	router.HandlerFunc(http.MethodGet, "/v1/cars/:id/history", app.requirePermission("cars:read", app.carHistoryHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/cars/:id", app.requirePermission("cars:write", app.updateCarHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/cars/:id", app.requirePermission("cars:delete", app.deleteCarHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/cars/:id/purge", app.requirePermission("vehicles:purge", app.purgeCarHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/motorbikes", app.requirePermission("motorbikes:read", app.listMotorbikesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/motorbikes", app.requirePermission("motorbikes:write", app.createMotorbikeHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/motorbikes/:id", app.routeByID(app.methodNotAllowedResponse, map[string]http.HandlerFunc{
+		"import": app.requirePermission("motorbikes:write", app.importMotorbikesHandler),
+	}))
+	router.HandlerFunc(http.MethodPost, "/v1/motorbikes/:id/restore", app.requirePermission("motorbikes:delete", app.restoreMotorbikeHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/motorbikes/:id", app.routeByID(app.requirePermission("motorbikes:read", app.showMotorbikeHandler), map[string]http.HandlerFunc{
+		"facets": app.requirePermission("motorbikes:read", app.motorbikeFacetsHandler),
+		"export": app.requirePermission("motorbikes:read", app.exportMotorbikesHandler),
+		"trash":  app.requirePermission("motorbikes:read", app.trashMotorbikesHandler),
+	}))
+	router.HandlerFunc(http.MethodGet, "/v1/motorbikes/:id/history", app.requirePermission("motorbikes:read", app.motorbikeHistoryHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/motorbikes/:id", app.requirePermission("motorbikes:write", app.updateMotorbikeHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/motorbikes/:id", app.requirePermission("motorbikes:delete", app.deleteMotorbikeHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/motorbikes/:id/purge", app.requirePermission("vehicles:purge", app.purgeMotorbikeHandler))
 
 	return app.recoverPanic(app.rateLimit(app.authenticate(router)))
 }
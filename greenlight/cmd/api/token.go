@@ -27,13 +27,33 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
+	// Before checking the password, make sure there haven't been too many failed
+	// attempts to sign in to this account or from this IP address recently. If there
+	// have, the client has to wait before trying again. Otherwise the attempt is
+	// reserved, counting it as a failure until we know better, so that a burst of
+	// parallel guesses is slowed down just like guesses one after another.
+	retryAfter, err := app.reserveLoginAttempt(r, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if retryAfter > 0 {
+		app.loginThrottledResponse(w, r, retryAfter)
+		return
+	}
 	// Lookup the user record based on the email address. If no matching user was
 	// found, then we call the app.invalidCredentialsResponse() helper to send a 401
 	// Unauthorized response to the client (we will create this helper in a moment).
+	// The attempt counts as a failure just the same as a wrong password, so the
+	// response doesn't give away whether the account exists.
 	user, err := app.models.Users.GetByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			if err := app.recordLoginFailure(r, input.Email, nil); err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -49,19 +69,312 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	// If the passwords don't match, then we call the app.invalidCredentialsResponse()
 	// helper again and return.
 	if !match {
+		if err := app.recordLoginFailure(r, input.Email, user); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
-	// Otherwise, if the password is correct, we generate a new token with a 24-hour
-	// expiry time and the scope 'authentication'.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// A user whose account has been deactivated by an administrator can't sign in. The
+	// password was right, though, so the attempt doesn't count as a failure.
+	if user.DeactivatedAt != nil {
+		if err := app.releaseLoginAttempt(r, input.Email); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.deactivatedAccountResponse(w, r)
+		return
+	}
+	// If the user has two-factor authentication enabled, they aren't signed in yet.
+	// Instead we send them a short-lived mfa-pending token, which they exchange for
+	// their authentication token along with a code from their authenticator app.
+	mfaEnabled, err := app.models.TOTP.Enabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if mfaEnabled {
+		// Give back the attempt without forgetting the account's earlier failures, so
+		// that wrong codes still count towards a lockout.
+		err = app.releaseLoginAttempt(r, input.Email)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		token, err := app.models.Tokens.New(user.ID, 5*time.Minute, data.ScopeMFAPending)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		err = app.writeJSON(w, http.StatusCreated, envelope{"mfa_token": token}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Otherwise the user has signed in, so forget any earlier failed attempts for the
+	// account. With two-factor authentication enabled this waits until the code has
+	// been checked too, so that wrong codes count towards a lockout.
+	err = app.resetLoginFailures(r, input.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	// Then we start a new session and send the tokens in the response along with a 201
+	// Created status code.
+	env, err := app.newSession(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The newSession() method starts a new session for a user who has signed in, by
+// generating a short-lived authentication token together with a refresh token. In JWT
+// mode the authentication token is signed rather than stored. It returns the envelope
+// holding the tokens to send to the client.
+func (app *application) newSession(user *data.User) (envelope, error) {
+	authenticationToken, refreshToken, err := app.models.Tokens.NewPair(user.ID, app.storedAuthenticationTTL(), app.config.tokens.refreshTTL)
+	if err != nil {
+		return nil, err
+	}
+	if app.jwtKeys != nil {
+		authenticationToken, err = app.newSignedToken(user, refreshToken.FamilyID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return envelope{"authentication_token": authenticationToken, "refresh_token": refreshToken}, nil
+}
+
+// The refreshTokenHandler() exchanges a refresh token for a new authentication token
+// and a new refresh token. Each refresh token can only be used once: presenting one
+// which has already been exchanged revokes the whole session, since it means the token
+// has probably been stolen.
+func (app *application) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	authenticationToken, refreshToken, err := app.models.Tokens.Rotate(input.RefreshToken, app.storedAuthenticationTTL(), app.config.tokens.refreshTTL)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound), errors.Is(err, data.ErrTokenReused):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
-	// Encode the token to JSON and send it in the response along with a 201 Created
-	// status code.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	// In JWT mode, sign a new authentication token using the user's current activation
+	// status and permissions, so any changes to them are picked up on refresh.
+	if app.jwtKeys != nil {
+		user, err := app.models.Users.GetForToken(data.ScopeRefresh, refreshToken.Plaintext)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		authenticationToken, err = app.newSignedToken(user, refreshToken.FamilyID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	env := envelope{"authentication_token": authenticationToken, "refresh_token": refreshToken}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createPasswordResetTokenHandler() generates a password reset token for an
+// activated user and emails it to them. The token expires after 45 minutes. Like
+// createActivationTokenHandler(), it sends the same response whether or not a token was
+// actually sent, so it doesn't reveal which email addresses have accounts or whether
+// they are activated.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate the user's email address.
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	env := envelope{"message": "if an activated account exists for this email address, an email will be sent to it containing password reset instructions"}
+
+	// Try to retrieve the corresponding user record for the email address. Only
+	// activated accounts which haven't been deactivated get a token.
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err == nil && user.Activated && user.DeactivatedAt == nil {
+		// Create a new password reset token with a 45-minute expiry time.
+		token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		// Email the user with their password reset token.
+		app.background(func() {
+			data := map[string]any{
+				"passwordResetToken": token.Plaintext,
+			}
+			// Since email addresses MAY be case sensitive, notice that we are sending
+			// this email using the address stored in our database for the user --- not
+			// to the input.Email address provided by the client in this request.
+			err := app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	// Send a 202 Accepted response and confirmation message to the client.
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createActivationTokenHandler() sends a fresh activation token to a user whose
+// account hasn't been activated yet, replacing any activation tokens they already have.
+// To avoid revealing which email addresses have accounts, the client gets the same
+// response whether or not a token was actually sent.
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate the user's email address.
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	env := envelope{"message": "if an unactivated account exists for this email address, an email will be sent to it containing activation instructions"}
+
+	// Try to retrieve the corresponding user record for the email address. If there
+	// isn't one, or the account is already activated, there's nothing to send. The same
+	// goes for an account which has been deactivated, which only an administrator can
+	// reactivate.
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if err == nil && !user.Activated && user.DeactivatedAt == nil {
+		// Delete any activation tokens the user already has, so only the newest one
+		// works, then create a new one with the same 3-day expiry as at registration.
+		err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		// Email the user with their new activation token.
+		app.background(func() {
+			data := map[string]any{
+				"activationToken": token.Plaintext,
+			}
+			err := app.mailer.Send(user.Email, "token_activation.tmpl", data)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	// Send a 202 Accepted response and confirmation message to the client.
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The listTokensHandler() lists the caller's active sessions, that is the token families
+// started each time they signed in which haven't expired or been revoked.
+func (app *application) listTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID, app.contextGetToken(r), app.contextGetSessionID(r))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteAuthenticationTokenHandler() logs the caller out by revoking the bearer
+// token the request was made with, along with the rest of its session. A signed token
+// can't be revoked, so its session is revoked instead and the token stops working once
+// it expires and can't be refreshed. A request made with an API key has no session to
+// sign out of, so it is rejected.
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	token, sessionID := app.contextGetToken(r), app.contextGetSessionID(r)
+	if token == "" && sessionID == 0 {
+		app.sessionRequiredResponse(w, r)
+		return
+	}
+	var err error
+	if token != "" {
+		err = app.models.Tokens.DeleteFamily(data.ScopeAuthentication, token)
+	} else {
+		err = app.models.Tokens.DeleteSession(app.contextGetUser(r).ID, sessionID)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been signed out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteAllAuthenticationTokensHandler() signs the caller out everywhere by revoking
+// all of their authentication and refresh tokens, including the current ones.
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	for _, scope := range []string{data.ScopeAuthentication, data.ScopeRefresh} {
+		err := app.models.Tokens.DeleteAllForUser(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	err := app.writeJSON(w, http.StatusOK, envelope{"message": "you have been signed out of all sessions"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"github.com/fara/fakeauto/internal/data"
+	"github.com/fara/fakeauto/internal/totp"
+	"github.com/fara/fakeauto/internal/validator"
+	"net/http"
+	"time"
+)
+
+// The issuer shown next to the account in the user's authenticator app.
+const totpIssuer = "FakeAuto"
+
+// The enrollTOTPHandler() starts enrolling the caller in two-factor authentication. It
+// generates a new secret and returns it along with an otpauth:// URI, which the client
+// can show as a QR code for the user to scan with their authenticator app. Two-factor
+// authentication isn't enabled until the user confirms a code with
+// confirmTOTPHandler(). Like the other two-factor endpoints, it needs a signed in
+// session, since a leaked API key could otherwise enroll a secret its holder controls
+// and lock the user out.
+func (app *application) enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	// Load the user's details, since requests made with a signed token only carry the
+	// user's id and we need their email address to label the account.
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.TOTP.Enroll(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTOTPEnabled):
+			v := validator.New()
+			v.AddError("totp", "two-factor authentication is already enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"totp": map[string]string{
+		"secret": secret,
+		"uri":    totp.URI(totpIssuer, user.Email, secret),
+	}}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The confirmTOTPHandler() finishes enrolling the caller in two-factor authentication,
+// once they have sent a valid code from their authenticator app. The response holds the
+// user's recovery codes, which are only ever shown this once.
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(input.Code != "", "code", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	secret, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("totp", "two-factor authentication enrollment has not been started")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if secret.Confirmed {
+		v.AddError("totp", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	step, ok := totp.Validate(secret.Secret, input.Code, time.Now(), 1)
+	if !ok {
+		v.AddError("code", "invalid code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	recoveryCodes, err := app.models.TOTP.Confirm(user.ID, step)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTOTPEnabled):
+			v.AddError("totp", "two-factor authentication is already enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": recoveryCodes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The deleteTOTPHandler() turns off two-factor authentication for the caller. To make
+// sure it is really them, they must send a current code or one of their recovery codes.
+// Wrong codes are throttled just like at sign in, so that someone who has got hold of
+// a session can't guess their way to turning two-factor authentication off.
+func (app *application) deleteTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if validateSecondFactor(v, input.Code, input.RecoveryCode); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Load the user's details, since requests made with a signed token only carry the
+	// user's id and failures are counted against their email address.
+	user, err := app.models.Users.Get(app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	retryAfter, err := app.reserveLoginAttempt(r, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if retryAfter > 0 {
+		app.loginThrottledResponse(w, r, retryAfter)
+		return
+	}
+	ok, err := app.checkSecondFactor(user.ID, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		if err := app.recordLoginFailure(r, user.Email, user); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+	err = app.resetLoginFailures(r, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.TOTP.Delete(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication has been disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The createMFAAuthenticationTokenHandler() completes signing in for a user with
+// two-factor authentication enabled. It exchanges the mfa-pending token returned by
+// createAuthenticationTokenHandler(), together with a code from the user's
+// authenticator app or a recovery code, for their authentication and refresh tokens.
+func (app *application) createMFAAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	data.ValidateTokenPlaintext(v, input.MFAToken)
+	validateSecondFactor(v, input.Code, input.RecoveryCode)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeMFAPending, input.MFAToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	// Wrong codes are throttled in the same way as wrong passwords.
+	retryAfter, err := app.reserveLoginAttempt(r, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if retryAfter > 0 {
+		app.loginThrottledResponse(w, r, retryAfter)
+		return
+	}
+	ok, err := app.checkSecondFactor(user.ID, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !ok {
+		if err := app.recordLoginFailure(r, user.Email, user); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+	err = app.resetLoginFailures(r, user.Email)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The mfa-pending token has done its job, so delete it before starting the session.
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeMFAPending, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	env, err := app.newSession(user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The validateSecondFactor() function checks that exactly one of a TOTP code and a
+// recovery code was provided.
+func validateSecondFactor(v *validator.Validator, code, recoveryCode string) {
+	v.Check(code != "" || recoveryCode != "", "code", "must be provided")
+	v.Check(code == "" || recoveryCode == "", "recovery_code", "must not be provided together with code")
+}
+
+// The checkSecondFactor() method checks a TOTP code, or else a recovery code, for a user
+// with two-factor authentication enabled. Each code can only be used once: a TOTP code
+// is spent along with every earlier one, and a recovery code is marked as used.
+func (app *application) checkSecondFactor(userID int64, code, recoveryCode string) (bool, error) {
+	secret, err := app.models.TOTP.Get(userID)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		return false, nil
+	case err != nil:
+		return false, err
+	case !secret.Confirmed:
+		return false, nil
+	}
+
+	if recoveryCode != "" {
+		err := app.models.TOTP.UseRecoveryCode(userID, recoveryCode)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		case err != nil:
+			return false, err
+		}
+		return true, nil
+	}
+
+	step, ok := totp.Validate(secret.Secret, code, time.Now(), 1)
+	if !ok {
+		return false, nil
+	}
+	err = app.models.TOTP.UseStep(userID, step)
+	switch {
+	case errors.Is(err, data.ErrTOTPCodeReused):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
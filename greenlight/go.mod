@@ -1,6 +1,6 @@
 module github.com/fara/fakeauto
 
-go 1.19
+go 1.20
 
 require github.com/julienschmidt/httprouter v1.3.0
 
@@ -0,0 +1,213 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fara/fakeauto/internal/validator"
+	"github.com/lib/pq"
+)
+
+// An APIKey is a named, long-lived credential which a user hands to a script or other
+// machine client instead of their password. The plaintext key is only known when the
+// key is created; after that only its hash is kept. Expiry is nil for a key which never
+// expires.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	Name        string      `json:"name"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	UserID      int64       `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Expiry      *time.Time  `json:"expiry"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+}
+
+// The generateAPIKey() function works like generateToken(), but uses 32 random bytes,
+// which gives a 52 character key.
+func generateAPIKey() (plaintext string, hash []byte, err error) {
+	randomBytes := make([]byte, 32)
+	_, err = rand.Read(randomBytes)
+	if err != nil {
+		return "", nil, err
+	}
+	plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	sum := sha256.Sum256([]byte(plaintext))
+	return plaintext, sum[:], nil
+}
+
+// ValidateAPIKey() checks the details of a new API key. Checking that its permissions
+// are held by the user is left to the caller.
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+	v.Check(len(key.Permissions) > 0, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+	if key.Expiry != nil {
+		v.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+// Check that the plaintext API key has been provided and is exactly 52 bytes long.
+func ValidateAPIKeyPlaintext(v *validator.Validator, plaintext string) {
+	v.Check(plaintext != "", "key", "must be provided")
+	v.Check(len(plaintext) == 52, "key", "must be 52 bytes long")
+}
+
+// Define the APIKeyModel type.
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// The Insert() method generates the plaintext and hash for a new API key and adds it to
+// the api_keys table, filling in its id and creation time.
+func (m APIKeyModel) Insert(key *APIKey) error {
+	plaintext, hash, err := generateAPIKey()
+	if err != nil {
+		return err
+	}
+	key.Plaintext = plaintext
+	key.Hash = hash
+
+	query := `
+	INSERT INTO api_keys (user_id, name, hash, permissions, expiry)
+	VALUES ($1, $2, $3, $4, $5)
+	RETURNING id, created_at`
+	args := []any{key.UserID, key.Name, key.Hash, pq.Array(key.Permissions), key.Expiry}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// The GetAllForUser() method returns all of a user's API keys, including expired ones,
+// newest first.
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+	SELECT id, name, permissions, created_at, expiry, last_used_at
+	FROM api_keys
+	WHERE user_id = $1
+	ORDER BY id DESC`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []*APIKey{}
+	for rows.Next() {
+		key := APIKey{UserID: userID}
+		err := rows.Scan(&key.ID, &key.Name, pq.Array(&key.Permissions), &key.CreatedAt, &key.Expiry, &key.LastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// The Delete() method revokes one of a user's API keys. It returns ErrRecordNotFound if
+// the user has no key with that id.
+func (m APIKeyModel) Delete(id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+	DELETE FROM api_keys
+	WHERE id = $1 AND user_id = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// The GetForKey() method returns the user an unexpired API key belongs to, along with
+// the key. The key's Permissions are narrowed down to those the user still holds, in the
+// same way as Permissions.Include() checks them, so revoking a permission from a user
+// also takes it away from their keys.
+func (m APIKeyModel) GetForKey(plaintext string) (*User, *APIKey, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	query := fmt.Sprintf(`
+	SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version, users.deactivated_at,
+		api_keys.id, api_keys.name, api_keys.created_at, api_keys.expiry, api_keys.last_used_at,
+		ARRAY(
+			SELECT key_code
+			FROM unnest(api_keys.permissions) AS key_code
+			WHERE EXISTS (
+				SELECT 1
+				FROM (%s) AS held
+				WHERE held.code = key_code
+				OR (right(held.code, 2) = ':*' AND left(key_code, length(held.code) - 1) = left(held.code, -1)
+					AND right(key_code, 4) <> ':any')
+			)
+		)
+	FROM users
+	INNER JOIN api_keys ON users.id = api_keys.user_id
+	WHERE api_keys.hash = $1
+	AND (api_keys.expiry IS NULL OR api_keys.expiry > NOW())`, fmt.Sprintf(userPermissionCodes, "users.id"))
+	var user User
+	var key APIKey
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, hash[:]).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.DeactivatedAt,
+		&key.ID,
+		&key.Name,
+		&key.CreatedAt,
+		&key.Expiry,
+		&key.LastUsedAt,
+		pq.Array(&key.Permissions),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	key.UserID = user.ID
+	key.Hash = hash[:]
+	return &user, &key, nil
+}
+
+// Touch() records that an API key has just been used. Like TokenModel.Touch(), it only
+// writes if the last recorded use was more than a minute ago.
+func (m APIKeyModel) Touch(id int64) error {
+	query := `
+	UPDATE api_keys
+	SET last_used_at = NOW()
+	WHERE id = $1
+	AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
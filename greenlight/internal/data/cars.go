@@ -5,7 +5,10 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
+
+	"github.com/fara/fakeauto/internal/validator"
 )
 
 type Car struct {
@@ -23,48 +26,144 @@ type Car struct {
 	Origin       string    `json:"origin"`
 	Version      int32     `json:"version"` // The version number starts at 1 and will be incremented each
 	// time the movie information is updated
+	DeletedAt *time.Time `json:"deleted_at,omitempty"` // When the record was moved to the trash, nil if it is live
+	CreatedBy *int64     `json:"-"`                    // The user who created the record, nil if they have since been deleted
+}
+
+// The fields() method maps the columns of the cars table to pointers at the matching
+// Car fields, so that a column can be looked up by name.
+func (car *Car) fields() map[string]any {
+	return map[string]any{
+		"id":           &car.ID,
+		"created_at":   &car.CreatedAt,
+		"name":         &car.Name,
+		"body":         &car.Body,
+		"brake_system": &car.BrakeSystem,
+		"aspiration":   &car.Aspiration,
+		"horsepower":   &car.Horsepower,
+		"mpg":          &car.Mpg,
+		"cylinders":    &car.Cylinders,
+		"acceleration": &car.Acceleration,
+		"displacement": &car.Displacement,
+		"origin":       &car.Origin,
+		"version":      &car.Version,
+		"deleted_at":   &car.DeletedAt,
+		"created_by":   &car.CreatedBy,
+	}
+}
+
+// ValidateCar checks the fields of a car before it is inserted or updated.
+func ValidateCar(v *validator.Validator, car *Car) {
+	v.Check(car.Name != "", "name", "must be provided")
+	v.Check(len(car.Name) <= 500, "name", "must not be more than 500 bytes long")
+
+	v.Check(car.Body != "", "body", "must be provided")
+	v.Check(len(car.Body) <= 50, "body", "must not be more than 50 bytes long")
+
+	v.Check(car.BrakeSystem != "", "brake_system", "must be provided")
+	v.Check(len(car.BrakeSystem) <= 50, "brake_system", "must not be more than 50 bytes long")
+
+	v.Check(car.Aspiration != "", "aspiration", "must be provided")
+	v.Check(len(car.Aspiration) <= 50, "aspiration", "must not be more than 50 bytes long")
+
+	v.Check(car.Horsepower != 0, "horsepower", "must be provided")
+	v.Check(car.Horsepower <= 2000, "horsepower", "must be less than 2000")
+
+	v.Check(car.Mpg != 0, "mpg", "must be provided")
+
+	v.Check(car.Cylinders != 0, "cylinders", "must be provided")
+	v.Check(car.Cylinders%2 == 0 && car.Cylinders != 2, "cylinders", "must be 4, 6, 8, 12 etc...")
+
+	v.Check(car.Acceleration != 0, "acceleration", "must be provided")
+
+	v.Check(car.Displacement != 0, "displacement", "must be provided")
+
+	v.Check(car.Origin != "", "origin", "must be provided")
+	v.Check(len(car.Origin) <= 50, "origin", "must not be more than 50 bytes long")
+}
+
+// The columns of the cars table, in table order.
+var carColumns = []string{"id", "created_at", "name", "body", "brake_system", "aspiration", "horsepower", "mpg",
+	"cylinders", "acceleration", "displacement", "origin", "version", "deleted_at", "created_by"}
+
+// The Project() method returns a map holding only the named fields of the car, for
+// responses where the client asked for a sparse fieldset.
+func (car *Car) Project(names []string) map[string]any {
+	return project(car.fields(), names)
 }
 
 type CarModel struct {
 	DB *sql.DB
 }
 
-func (c CarModel) Insert(car *Car) error {
+// The insertChange() method describes the insert of a car, which fills in the id,
+// created_at and version of the car once it has been applied.
+func (c CarModel) insertChange(car *Car, userID int64) rowChange {
 	query := `
-		INSERT INTO cars(name,body,brake_system,aspiration,horsepower,mpg,cylinders,acceleration,displacement,origin)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9,$10)
-		RETURNING id, created_at, version`
+		INSERT INTO cars(name,body,brake_system,aspiration,horsepower,mpg,cylinders,acceleration,displacement,origin,created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		RETURNING to_jsonb(cars), id, created_at, version`
 
-	return c.DB.QueryRow(query, &car.Name, &car.Body, &car.BrakeSystem, &car.Aspiration, &car.Horsepower, &car.Mpg, &car.Cylinders, &car.Acceleration, &car.Displacement, &car.Origin).Scan(&car.ID, &car.CreatedAt, &car.Version)
+	args := []any{
+		car.Name,
+		car.Body,
+		car.BrakeSystem,
+		car.Aspiration,
+		car.Horsepower,
+		car.Mpg,
+		car.Cylinders,
+		car.Acceleration,
+		car.Displacement,
+		car.Origin,
+		userID,
+	}
+	car.CreatedBy = &userID
+
+	return rowChange{
+		table:  "cars",
+		action: HistoryInsert,
+		userID: userID,
+		stmt:   query,
+		args:   args,
+		dest:   []any{&car.ID, &car.CreatedAt, &car.Version},
+	}
+}
+
+// Insert() adds a new car, recording the user who added it as its owner and in the
+// history.
+func (c CarModel) Insert(car *Car, userID int64) error {
+	return applyChanges(c.DB, 3*time.Second, c.insertChange(car, userID))
+}
+
+// InsertMany() inserts a batch of cars in a single transaction, filling in the id,
+// created_at and version of each one. Either every car is inserted or, if any insert
+// fails, none of them are.
+func (c CarModel) InsertMany(cars []*Car, userID int64) error {
+	changes := make([]rowChange, len(cars))
+	for i, car := range cars {
+		changes[i] = c.insertChange(car, userID)
+	}
+	// Allow a longer timeout than usual, since a batch can hold thousands of rows.
+	return applyChanges(c.DB, 30*time.Second, changes...)
 }
 
-func (c CarModel) Get(id int64) (*Car, error) {
+// Get() fetches a live car by id, ignoring any in the trash. If any fields are
+// given, only those columns (plus the id and version, which make up the ETag) are read
+// from the database and the remaining fields are left at their zero values.
+func (c CarModel) Get(id int64, fields ...string) (*Car, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
-	query := `
-		SELECT *
+	columns := selectColumns(carColumns, fields, "id", "version")
+	query := fmt.Sprintf(`
+		SELECT %s
 		FROM cars
-		WHERE id = $1`
+		WHERE id = $1 AND deleted_at IS NULL`, strings.Join(columns, ", "))
 
 	var car Car
 
-	err := c.DB.QueryRow(query, id).Scan(
-		&car.ID,
-		&car.CreatedAt,
-		&car.Name,
-		&car.Body,
-		&car.BrakeSystem,
-		&car.Aspiration,
-		&car.Horsepower,
-		&car.Mpg,
-		&car.Cylinders,
-		&car.Acceleration,
-		&car.Displacement,
-		&car.Origin,
-		&car.Version,
-	)
+	err := c.DB.QueryRow(query, id).Scan(scanDest(car.fields(), columns)...)
 
 	if err != nil {
 		switch {
@@ -79,14 +178,23 @@ func (c CarModel) Get(id int64) (*Car, error) {
 
 }
 
-func (c CarModel) Update(car *Car) error {
+// Update() saves the changes to a car, as long as it is still live and at the version
+// the caller read. The old and new values of the changed fields are recorded in the
+// history.
+func (c CarModel) Update(car *Car, userID int64) error {
+	lock := `
+		SELECT to_jsonb(cars)
+		FROM cars
+		WHERE id = $1 AND version = $2 AND deleted_at IS NULL
+		FOR UPDATE`
+
 	query := `
 		UPDATE cars
 		SET name = $1, body = $2, brake_system = $3, aspiration = $4, horsepower = $5, mpg = $6, cylinders = $7, acceleration = $8, displacement = $9, origin = $10, version = version + 1
-		WHERE id = $11 AND version = $12
-		RETURNING version`
+		WHERE id = $11
+		RETURNING to_jsonb(cars), version`
 
-	args := []interface{}{
+	args := []any{
 		car.Name,
 		car.Body,
 		car.BrakeSystem,
@@ -98,60 +206,177 @@ func (c CarModel) Update(car *Car) error {
 		car.Displacement,
 		car.Origin,
 		car.ID,
-		car.Version,
 	}
 
-	err := c.DB.QueryRow(query, args...).Scan(&car.Version)
+	return applyChanges(c.DB, 3*time.Second, rowChange{
+		table:    "cars",
+		action:   HistoryUpdate,
+		userID:   userID,
+		lock:     lock,
+		lockArgs: []any{car.ID, car.Version},
+		missing:  ErrEditConflict,
+		stmt:     query,
+		args:     args,
+		dest:     []any{&car.Version},
+	})
+}
+
+// Delete() moves a car to the trash by setting its deleted_at timestamp, but only if
+// it is still at the given version, so a client can't delete a record which was changed
+// after it last read it. If no live row matches we return ErrEditConflict, and the
+// caller is expected to have checked that the record exists beforehand.
+func (c CarModel) Delete(id int64, version int32, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	lock := `
+		SELECT to_jsonb(cars)
+		FROM cars
+		WHERE id = $1 AND version = $2 AND deleted_at IS NULL
+		FOR UPDATE`
+
+	query := `
+		UPDATE cars
+		SET deleted_at = NOW(), version = version + 1
+		WHERE id = $1
+		RETURNING to_jsonb(cars)`
+
+	return applyChanges(c.DB, 3*time.Second, rowChange{
+		table:    "cars",
+		action:   HistoryDelete,
+		userID:   userID,
+		lock:     lock,
+		lockArgs: []any{id, version},
+		missing:  ErrEditConflict,
+		stmt:     query,
+		args:     []any{id},
+	})
+}
+
+// GetOwner() returns the id of the user who created a car, whether it is live or in
+// the trash, or nil if that isn't known.
+func (c CarModel) GetOwner(id int64) (*int64, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT created_by
+		FROM cars
+		WHERE id = $1`
+	var createdBy *int64
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := c.DB.QueryRowContext(ctx, query, id).Scan(&createdBy)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
+			return nil, ErrRecordNotFound
 		default:
-			return err
+			return nil, err
 		}
 	}
-	return nil
+	return createdBy, nil
 }
 
-func (c CarModel) Delete(id int64) error {
+// Restore() moves a car out of the trash, returning ErrRecordNotFound if there is no
+// such car in the trash.
+func (c CarModel) Restore(id int64, userID int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
-	query := `
-		DELETE FROM cars
-		WHERE id = $1`
+	lock := `
+		SELECT to_jsonb(cars)
+		FROM cars
+		WHERE id = $1 AND deleted_at IS NOT NULL
+		FOR UPDATE`
 
-	result, err := c.DB.Exec(query, id)
-	if err != nil {
-		return err
-	}
+	query := `
+		UPDATE cars
+		SET deleted_at = NULL, version = version + 1
+		WHERE id = $1
+		RETURNING to_jsonb(cars)`
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return err
-	}
+	return applyChanges(c.DB, 3*time.Second, rowChange{
+		table:    "cars",
+		action:   HistoryRestore,
+		userID:   userID,
+		lock:     lock,
+		lockArgs: []any{id},
+		missing:  ErrRecordNotFound,
+		stmt:     query,
+		args:     []any{id},
+	})
+}
 
-	if rowsAffected == 0 {
+// Purge() permanently deletes a car. Only records which are already in the trash can
+// be purged, so a live record always has to be deleted first. Its history is kept.
+func (c CarModel) Purge(id int64, userID int64) error {
+	if id < 1 {
 		return ErrRecordNotFound
 	}
 
-	return nil
+	lock := `
+		SELECT to_jsonb(cars)
+		FROM cars
+		WHERE id = $1 AND deleted_at IS NOT NULL
+		FOR UPDATE`
+
+	query := `
+		DELETE FROM cars
+		WHERE id = $1
+		RETURNING NULL::jsonb`
+
+	return applyChanges(c.DB, 3*time.Second, rowChange{
+		table:    "cars",
+		action:   HistoryPurge,
+		userID:   userID,
+		lock:     lock,
+		lockArgs: []any{id},
+		missing:  ErrRecordNotFound,
+		stmt:     query,
+		args:     []any{id},
+	})
 }
 
-func (c CarModel) GetAll(title string, filters Filters) ([]*Car, Metadata, error) {
+// History() returns a page of the changes made to a car, including those made while it
+// was in the trash and after it was purged.
+func (c CarModel) History(id int64, filters Filters) ([]*HistoryEntry, Metadata, error) {
+	return history(c.DB, "cars", id, filters)
+}
+
+// GetVersion() reconstructs a car as it was at a past version from its history. It
+// returns ErrRecordNotFound if the car never reached that version, or if the history
+// doesn't go back that far.
+func (c CarModel) GetVersion(id int64, version int32) (*Car, error) {
+	var car Car
+	err := reconstruct(c.DB, "cars", id, version, car.fields())
+	if err != nil {
+		return nil, err
+	}
+	return &car, nil
+}
+
+func (c CarModel) GetAll(search SearchFilters, filters Filters, fields ...string) ([]*Car, Metadata, error) {
 	// Update the SQL query to include the window function which counts the total
 	// (filtered) records.
 	// (filtered) records.
+	// Compile the search filters into the WHERE clause and its arguments.
+	where, args := search.where()
+	// Add the keyset condition when the client is paging with a cursor.
+	seek, args := filters.seek(args)
+	// Read only the requested fields, plus the id and sort columns the cursors need.
+	columns := selectColumns(carColumns, fields, append(filters.sortColumns(), "id")...)
 	query := fmt.Sprintf(`
-SELECT count(*) OVER(), id, created_at, name, body, brake_system, aspiration,horsepower,mpg,cylinders,acceleration,displacement,origin, version
+SELECT count(*) OVER(), %s
 FROM cars
-WHERE (to_tsvector('simple', name) @@ plainto_tsquery('simple', $1) OR $1 = '')
-ORDER BY %s %s, id ASC
-LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+%s %s
+ORDER BY %s
+LIMIT $%d OFFSET $%d`, strings.Join(columns, ", "), where, seek, filters.orderBy(), len(args)+1, len(args)+2)
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	args := []any{title, filters.limit(), filters.offset()}
+	args = append(args, filters.limit(), filters.offset())
 	rows, err := c.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err // Update this to return an empty Metadata struct.
@@ -162,22 +387,10 @@ LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
 	cars := []*Car{}
 	for rows.Next() {
 		var car Car
-		err := rows.Scan(
-			&totalRecords, // Scan the count from the window function into totalRecords.
-			&car.ID,
-			&car.CreatedAt,
-			&car.Name,
-			&car.Body,
-			&car.BrakeSystem,
-			&car.Aspiration,
-			&car.Horsepower,
-			&car.Mpg,
-			&car.Cylinders,
-			&car.Acceleration,
-			&car.Displacement,
-			&car.Origin,
-			&car.Version,
-		)
+		// Scan the count from the window function into totalRecords, followed by the
+		// selected columns.
+		dest := append([]any{&totalRecords}, scanDest(car.fields(), columns)...)
+		err := rows.Scan(dest...)
 		if err != nil {
 			return nil, Metadata{}, err // Update this to return an empty Metadata struct.
 		}
@@ -187,8 +400,50 @@ LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
 		return nil, Metadata{}, err // Update this to return an empty Metadata struct.
 	}
 	// Generate a Metadata struct, passing in the total record count and pagination
-	// parameters from the client.
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	// parameters from the client, and trim the page down when paging with a cursor.
+	cars, metadata := paginate(cars, totalRecords, filters, (*Car).fields)
 	// Include the metadata struct when returning.
 	return cars, metadata, nil
 }
+
+// Export() streams every car matching the search filters, in the order given by the
+// filters' sort keys, calling fn for each one as soon as it is read rather than
+// collecting them all in memory. If any fields are given only those columns (and the
+// id) are read. There is no paging and no fixed query timeout, so the export runs for as
+// long as ctx allows; the caller is responsible for any deadline on writing the records
+// out. If fn returns an error the export stops and that error is returned.
+func (c CarModel) Export(ctx context.Context, search SearchFilters, filters Filters, fn func(*Car) error, fields ...string) error {
+	where, args := search.where()
+	columns := selectColumns(carColumns, fields, "id")
+	query := fmt.Sprintf(`
+SELECT %s
+FROM cars
+%s
+ORDER BY %s`, strings.Join(columns, ", "), where, filters.orderBy())
+	rows, err := c.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var car Car
+		err := rows.Scan(scanDest(car.fields(), columns)...)
+		if err != nil {
+			return err
+		}
+		if err := fn(&car); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Facets() returns the sidebar counts for the cars matching the search filters: the
+// number of cars per body, origin, aspiration, brake system and cylinder count, plus a
+// horsepower histogram in 50hp buckets.
+func (c CarModel) Facets(search SearchFilters) (*Facets, error) {
+	return facets(c.DB, "cars", search,
+		[]string{"body", "origin", "aspiration", "brake_system", "cylinders"},
+		map[string]float64{"horsepower": 50},
+	)
+}
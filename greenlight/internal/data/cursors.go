@@ -0,0 +1,197 @@
+package data
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A cursor marks a position in a sorted listing: the sort parameter it was issued for,
+// the values of the sort columns in the boundary row, and that row's id as the
+// tiebreaker. Backward is set on cursors which page towards the start of the listing.
+// Clients only ever see the cursor as an opaque base64 string.
+type cursor struct {
+	Sort     string `json:"s"`
+	Values   []any  `json:"v"`
+	ID       int64  `json:"id"`
+	Backward bool   `json:"b,omitempty"`
+}
+
+func encodeCursor(c cursor) string {
+	js, err := json.Marshal(c)
+	if err != nil {
+		// The values are always read from scanned columns, so they can always be
+		// encoded. If this ever fails it is a logic error in our code.
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	// Decode numbers as json.Number so that values are passed on to PostgreSQL exactly
+	// as they were encoded, without a round trip through float64.
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	err = dec.Decode(&c)
+	return c, err
+}
+
+// A record is a row type, like Car or Motorbike, whose fields() method maps the columns
+// of its table to pointers at its fields.
+type record interface {
+	fields() map[string]any
+}
+
+// The cursorValueValid() function reports whether a value decoded from a cursor can be
+// compared with the column that ptr, taken from a record's fields() map, is scanned
+// into. A cursor is opaque to clients, but nothing stops them from editing one, and a
+// value of the wrong type would otherwise make the query fail.
+func cursorValueValid(value, ptr any) bool {
+	switch ptr.(type) {
+	case *int64:
+		n, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := n.Int64()
+		return err == nil
+	case *float64:
+		n, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := n.Float64()
+		return err == nil
+	case *string:
+		s, ok := value.(string)
+		// PostgreSQL doesn't accept NUL characters in text.
+		return ok && !strings.ContainsRune(s, 0)
+	case *bool:
+		_, ok := value.(bool)
+		return ok
+	case *time.Time, **time.Time:
+		s, ok := value.(string)
+		if !ok {
+			return false
+		}
+		_, err := time.Parse(time.RFC3339Nano, s)
+		return err == nil
+	default:
+		return false
+	}
+}
+
+// The backward() method reports whether the client is paging towards the start of the
+// listing. An invalid cursor is rejected by ValidateFilters() before we get here.
+func (f Filters) backward() bool {
+	if f.Cursor == "" {
+		return false
+	}
+	c, _ := decodeCursor(f.Cursor)
+	return c.Backward
+}
+
+// The seek() method compiles the cursor into a keyset condition, which selects the rows
+// that come after (or before, when paging backwards) the cursor position in the sort
+// order. For "sort=-horsepower,mpg" this is
+//
+//	AND (horsepower < $2 OR (horsepower = $2 AND mpg > $3)
+//	  OR (horsepower = $2 AND mpg = $3 AND id > $4))
+//
+// The placeholders are numbered after the existing args. Without a cursor it returns an
+// empty condition and the args unchanged.
+func (f Filters) seek(args []any) (string, []any) {
+	if f.Cursor == "" {
+		return "", args
+	}
+	c, _ := decodeCursor(f.Cursor)
+	values := c.Values
+	terms := f.orderTerms()
+	if len(values) < len(terms) {
+		values = append(values, c.ID)
+	}
+
+	placeholders := make([]string, len(terms))
+	for i := range terms {
+		args = append(args, values[i])
+		placeholders[i] = fmt.Sprintf("$%d", len(args))
+	}
+
+	var disjuncts []string
+	for i, term := range terms {
+		var conjuncts []string
+		for j := 0; j < i; j++ {
+			conjuncts = append(conjuncts, fmt.Sprintf("%s = %s", terms[j].column, placeholders[j]))
+		}
+		op := ">"
+		if term.descending != c.Backward {
+			op = "<"
+		}
+		conjuncts = append(conjuncts, fmt.Sprintf("%s %s %s", term.column, op, placeholders[i]))
+		disjuncts = append(disjuncts, "("+strings.Join(conjuncts, " AND ")+")")
+	}
+	return "AND (" + strings.Join(disjuncts, " OR ") + ")", args
+}
+
+// The cursorFor() method builds a cursor positioned on a row, given the row's columns as
+// returned by its fields() method.
+func (f Filters) cursorFor(fields map[string]any, backward bool) string {
+	c := cursor{Sort: f.Sort, Backward: backward}
+	for _, key := range f.sortKeys() {
+		c.Values = append(c.Values, fieldValue(fields[f.sortColumn(key)]))
+	}
+	c.ID = *fields["id"].(*int64)
+	return encodeCursor(c)
+}
+
+// The paginate() function turns the rows read by a listing query into the page returned
+// to the client along with its metadata. In offset mode the metadata is calculated as
+// before, with cursors added so clients can switch to keyset paging at any point. In
+// cursor mode the extra look-ahead row is dropped and, when paging backwards, the rows
+// are put back into the requested order.
+func paginate[T any](rows []T, totalRecords int, filters Filters, fields func(T) map[string]any) ([]T, Metadata) {
+	if filters.Cursor == "" {
+		metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+		if len(rows) > 0 {
+			if filters.offset()+len(rows) < totalRecords {
+				metadata.NextCursor = filters.cursorFor(fields(rows[len(rows)-1]), false)
+			}
+			if filters.Page > 1 {
+				metadata.PrevCursor = filters.cursorFor(fields(rows[0]), true)
+			}
+		}
+		return rows, metadata
+	}
+
+	backward := filters.backward()
+	hasMore := len(rows) > filters.PageSize
+	if hasMore {
+		rows = rows[:filters.PageSize]
+	}
+	if backward {
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+
+	metadata := Metadata{PageSize: filters.PageSize}
+	if len(rows) > 0 {
+		// We got here from a cursor, so there is always a page on the side we came
+		// from. On the side we are heading, there is only one if we read the extra row.
+		if hasMore || backward {
+			metadata.NextCursor = filters.cursorFor(fields(rows[len(rows)-1]), false)
+		}
+		if hasMore || !backward {
+			metadata.PrevCursor = filters.cursorFor(fields(rows[0]), true)
+		}
+	}
+	return rows, metadata
+}
@@ -0,0 +1,104 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// A FacetCount holds the number of matching records which have a given column value.
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// A HistogramBucket holds the number of matching records whose column value falls in
+// the half-open range [Min, Max).
+type HistogramBucket struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count int     `json:"count"`
+}
+
+// Facets holds the per-value counts and numeric histograms for a filtered listing, keyed
+// by column name.
+type Facets struct {
+	Values     map[string][]FacetCount      `json:"values"`
+	Histograms map[string][]HistogramBucket `json:"histograms"`
+}
+
+// The facets() function counts the rows of a table matching the search filters, grouped
+// by each of the value columns, and bucketed into histograms of the given widths for
+// each of the histogram columns. The table and column names are always supplied by the
+// models themselves and never by the client.
+func facets(db *sql.DB, table string, search SearchFilters, valueColumns []string, histogramColumns map[string]float64) (*Facets, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	where, args := search.where()
+	result := &Facets{
+		Values:     make(map[string][]FacetCount),
+		Histograms: make(map[string][]HistogramBucket),
+	}
+
+	for _, column := range valueColumns {
+		// Values are returned most common first. NULLs are reported as the empty string.
+		query := fmt.Sprintf(`
+SELECT COALESCE(%[1]s::text, ''), count(*)
+FROM %[2]s
+%[3]s
+GROUP BY %[1]s
+ORDER BY count(*) DESC, %[1]s ASC`, column, table, where)
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		counts := []FacetCount{}
+		for rows.Next() {
+			var fc FacetCount
+			if err := rows.Scan(&fc.Value, &fc.Count); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			counts = append(counts, fc)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		result.Values[column] = counts
+	}
+
+	for column, width := range histogramColumns {
+		query := fmt.Sprintf(`
+SELECT floor(%[1]s / $%[4]d) * $%[4]d AS lower, count(*)
+FROM %[2]s
+%[3]s
+GROUP BY lower
+ORDER BY lower ASC`, column, table, where, len(args)+1)
+		rows, err := db.QueryContext(ctx, query, append(args, width)...)
+		if err != nil {
+			return nil, err
+		}
+		buckets := []HistogramBucket{}
+		for rows.Next() {
+			var b HistogramBucket
+			if err := rows.Scan(&b.Min, &b.Count); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			b.Max = b.Min + width
+			buckets = append(buckets, b)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		result.Histograms[column] = buckets
+	}
+
+	return result, nil
+}
@@ -0,0 +1,60 @@
+package data
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/fara/fakeauto/internal/validator"
+)
+
+// ValidateFields checks that every field requested with the fields query string
+// parameter is in the safelist, and that none is requested twice.
+func ValidateFields(v *validator.Validator, fields []string, safelist []string) {
+	for _, field := range fields {
+		v.Check(validator.PermittedValue(field, safelist...), "fields", fmt.Sprintf("unknown field %q", field))
+	}
+	v.Check(validator.Unique(fields), "fields", "must not contain duplicate values")
+}
+
+// The selectColumns() function works out which of a table's columns a query needs to
+// read: all of them if no fields were requested, otherwise the requested fields plus any
+// extra columns the data layer relies on itself (like the id, or the sort columns used
+// to build cursors). The result is always a subset of columns, in table order, so only
+// known column names ever reach the query.
+func selectColumns(columns []string, fields []string, extra ...string) []string {
+	if len(fields) == 0 {
+		return columns
+	}
+	var selected []string
+	for _, column := range columns {
+		if validator.PermittedValue(column, fields...) || validator.PermittedValue(column, extra...) {
+			selected = append(selected, column)
+		}
+	}
+	return selected
+}
+
+// The scanDest() function returns the scan destinations for the given columns, taken
+// from a record's fields() map.
+func scanDest(fields map[string]any, columns []string) []any {
+	dest := make([]any, len(columns))
+	for i, column := range columns {
+		dest[i] = fields[column]
+	}
+	return dest
+}
+
+// The fieldValue() function dereferences a pointer from a record's fields() map.
+func fieldValue(ptr any) any {
+	return reflect.ValueOf(ptr).Elem().Interface()
+}
+
+// The project() function copies the requested fields of a record into a map, which
+// encodes to JSON with only those keys.
+func project(fields map[string]any, names []string) map[string]any {
+	projection := make(map[string]any, len(names))
+	for _, name := range names {
+		projection[name] = fieldValue(fields[name])
+	}
+	return projection
+}
@@ -1,24 +1,33 @@
 package data
 
 import (
+	"fmt"
 	"github.com/fara/fakeauto/internal/validator"
+	"github.com/lib/pq"
 	"math"
 	"strings"
 )
 
-// Add a SortSafelist field to hold the supported sort values.
+// Add a SortSafelist field to hold the supported sort values. Cursor holds the opaque
+// keyset cursor sent by the client; when it is set it takes the place of Page. Listings
+// which accept a cursor set Record to an empty record of the kind being listed, like
+// &Car{}, which tells ValidateFilters() the type of each sort column.
 type Filters struct {
 	Page         int
 	PageSize     int
 	Sort         string
 	SortSafelist []string
+	Cursor       string
+	Record       record
 }
 type Metadata struct {
-	CurrentPage  int `json:"current_page,omitempty"`
-	PageSize     int `json:"page_size,omitempty"`
-	FirstPage    int `json:"first_page,omitempty"`
-	LastPage     int `json:"last_page,omitempty"`
-	TotalRecords int `json:"total_records,omitempty"`
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PageSize     int    `json:"page_size,omitempty"`
+	FirstPage    int    `json:"first_page,omitempty"`
+	LastPage     int    `json:"last_page,omitempty"`
+	TotalRecords int    `json:"total_records,omitempty"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+	PrevCursor   string `json:"prev_cursor,omitempty"`
 }
 
 // The calculateMetadata() function calculates the appropriate pagination metadata
@@ -40,39 +49,229 @@ func calculateMetadata(totalRecords, page, pageSize int) Metadata {
 	}
 }
 
-// Check that the client-provided Sort field matches one of the entries in our safelist
-// and if it does, extract the column name from the Sort field by stripping the leading
-// hyphen character (if one exists).
-func (f Filters) sortColumn() string {
+// The SortSafelist() helper builds a sort safelist from a set of column names, allowing
+// each column to be sorted in ascending ("horsepower") and descending ("-horsepower")
+// order.
+func SortSafelist(columns ...string) []string {
+	safelist := make([]string, 0, len(columns)*2)
+	for _, column := range columns {
+		safelist = append(safelist, column, "-"+column)
+	}
+	return safelist
+}
+
+// The Sort field holds a comma-separated list of sort keys, such as "-horsepower,mpg".
+// The sortKeys() method splits it into the individual keys.
+func (f Filters) sortKeys() []string {
+	return strings.Split(f.Sort, ",")
+}
+
+// The sortColumns() method returns the columns named by the sort keys, which a listing
+// query must read in order to build the cursors for the page.
+func (f Filters) sortColumns() []string {
+	var columns []string
+	for _, key := range f.sortKeys() {
+		columns = append(columns, strings.TrimPrefix(key, "-"))
+	}
+	return columns
+}
+
+// Check that a sort key matches one of the entries in our safelist and if it does,
+// extract the column name from it by stripping the leading hyphen character (if one
+// exists).
+func (f Filters) sortColumn(key string) string {
 	for _, safeValue := range f.SortSafelist {
-		if f.Sort == safeValue {
-			return strings.TrimPrefix(f.Sort, "-")
+		if key == safeValue {
+			return strings.TrimPrefix(key, "-")
 		}
 	}
-	panic("unsafe sort parameter: " + f.Sort)
+	panic("unsafe sort parameter: " + key)
 }
 
 // Return the sort direction ("ASC" or "DESC") depending on the prefix character of the
-// Sort field.
-func (f Filters) sortDirection() string {
-	if strings.HasPrefix(f.Sort, "-") {
+// sort key.
+func sortDirection(key string) string {
+	if strings.HasPrefix(key, "-") {
 		return "DESC"
 	}
 	return "ASC"
 }
 
+// An orderTerm is a single column of the ORDER BY clause.
+type orderTerm struct {
+	column     string
+	descending bool
+}
+
+// The orderTerms() method resolves the sort keys into ORDER BY terms. Unless the client
+// already sorted on id, we always finish with "id ASC" as a tiebreaker so that the order
+// is stable between requests (and so that every row has a unique keyset position).
+func (f Filters) orderTerms() []orderTerm {
+	var terms []orderTerm
+	sortedByID := false
+	for _, key := range f.sortKeys() {
+		column := f.sortColumn(key)
+		if column == "id" {
+			sortedByID = true
+		}
+		terms = append(terms, orderTerm{column: column, descending: sortDirection(key) == "DESC"})
+	}
+	if !sortedByID {
+		terms = append(terms, orderTerm{column: "id"})
+	}
+	return terms
+}
+
+// The orderBy() method renders the sort keys into the body of an ORDER BY clause, e.g.
+// "horsepower DESC, mpg ASC, id ASC". When paging backwards from a cursor every
+// direction is flipped, and the rows are put back in order once they have been read.
+func (f Filters) orderBy() string {
+	backward := f.backward()
+	var clauses []string
+	for _, term := range f.orderTerms() {
+		direction := "ASC"
+		if term.descending != backward {
+			direction = "DESC"
+		}
+		clauses = append(clauses, term.column+" "+direction)
+	}
+	return strings.Join(clauses, ", ")
+}
+
+// ValidateSort checks that every key in the sort parameter matches a value in the
+// safelist, and that no column is sorted on twice.
+func ValidateSort(v *validator.Validator, f Filters) {
+	for _, key := range f.sortKeys() {
+		v.Check(validator.PermittedValue(key, f.SortSafelist...), "sort", "invalid sort value")
+	}
+	v.Check(validator.Unique(f.sortColumns()), "sort", "must not contain duplicate sort columns")
+}
+
 func ValidateFilters(v *validator.Validator, f Filters) {
 	// Check that the page and page_size parameters contain sensible values.
 	v.Check(f.Page > 0, "page", "must be greater than zero")
 	v.Check(f.Page <= 10_000_000, "page", "must be a maximum of 10 million")
 	v.Check(f.PageSize > 0, "page_size", "must be greater than zero")
 	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
-	// Check that the sort parameter matches a value in the safelist.
-	v.Check(validator.PermittedValue(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+	ValidateSort(v, f)
+	// A cursor replaces the page number, and it is only valid for the sort order it was
+	// issued for.
+	if f.Cursor != "" {
+		v.Check(f.Page == 1, "page", "must not be used together with cursor")
+		c, err := decodeCursor(f.Cursor)
+		if err != nil {
+			v.AddError("cursor", "invalid cursor")
+			return
+		}
+		v.Check(c.Sort == f.Sort, "cursor", "does not match the sort parameter")
+		v.Check(len(c.Values) == len(f.sortKeys()), "cursor", "invalid cursor")
+		if f.Record == nil || !v.Valid() {
+			return
+		}
+		// The values are passed to the query as they are, so check that each of them
+		// has the type of its sort column.
+		fields := f.Record.fields()
+		for i, column := range f.sortColumns() {
+			if !cursorValueValid(c.Values[i], fields[column]) {
+				v.AddError("cursor", "invalid cursor")
+				return
+			}
+		}
+	}
 }
+
+// In cursor mode we read one row more than the page size, which tells us whether there
+// is another page beyond this one without a separate count query.
 func (f Filters) limit() int {
+	if f.Cursor != "" {
+		return f.PageSize + 1
+	}
 	return f.PageSize
 }
 func (f Filters) offset() int {
+	if f.Cursor != "" {
+		return 0
+	}
 	return (f.Page - 1) * f.PageSize
 }
+
+// RangeFilter holds the optional inclusive lower and upper bounds for a numeric column.
+// A nil bound means that side of the range is open.
+type RangeFilter struct {
+	Min *float64
+	Max *float64
+}
+
+// SearchFilters holds the row filters shared by the vehicle listing endpoints: the
+// full-text name term, numeric ranges keyed by column and lists of accepted values keyed
+// by column. Just like SortSafelist, the safelists hold the only column names that are
+// ever interpolated into the SQL query. Deleted selects the records in the trash
+// instead of the live ones, and a non-zero CreatedBy only matches the records created
+// by that user.
+type SearchFilters struct {
+	Name          string
+	Ranges        map[string]RangeFilter
+	Values        map[string][]string
+	RangeSafelist []string
+	ValueSafelist []string
+	Deleted       bool
+	CreatedBy     int64
+}
+
+func ValidateSearchFilters(v *validator.Validator, s SearchFilters) {
+	for column, r := range s.Ranges {
+		v.Check(validator.PermittedValue(column, s.RangeSafelist...), column, "invalid filter column")
+		if r.Min != nil && r.Max != nil {
+			v.Check(*r.Min <= *r.Max, column+"_min", fmt.Sprintf("must not be greater than %s_max", column))
+		}
+	}
+	for column, values := range s.Values {
+		v.Check(validator.PermittedValue(column, s.ValueSafelist...), column, "invalid filter column")
+		for _, value := range values {
+			v.Check(value != "", column, "must not contain empty values")
+		}
+	}
+}
+
+// The where() method compiles the search filters into a parameterized WHERE clause,
+// which only matches live records, or only trashed ones if Deleted is set. The
+// name term is always bound to $1, so the returned clause can be used by the existing
+// queries unchanged, and the remaining placeholders are numbered after it. Columns are
+// taken from the safelists (in safelist order) rather than from the map keys, so a
+// column which isn't safelisted can never reach the query.
+func (s SearchFilters) where() (string, []any) {
+	conditions := []string{"(to_tsvector('simple', name) @@ plainto_tsquery('simple', $1) OR $1 = '')"}
+	args := []any{s.Name}
+	if s.Deleted {
+		conditions = append(conditions, "deleted_at IS NOT NULL")
+	} else {
+		conditions = append(conditions, "deleted_at IS NULL")
+	}
+	if s.CreatedBy != 0 {
+		args = append(args, s.CreatedBy)
+		conditions = append(conditions, fmt.Sprintf("created_by = $%d", len(args)))
+	}
+	for _, column := range s.RangeSafelist {
+		r, ok := s.Ranges[column]
+		if !ok {
+			continue
+		}
+		if r.Min != nil {
+			args = append(args, *r.Min)
+			conditions = append(conditions, fmt.Sprintf("%s >= $%d", column, len(args)))
+		}
+		if r.Max != nil {
+			args = append(args, *r.Max)
+			conditions = append(conditions, fmt.Sprintf("%s <= $%d", column, len(args)))
+		}
+	}
+	for _, column := range s.ValueSafelist {
+		values := s.Values[column]
+		if len(values) == 0 {
+			continue
+		}
+		args = append(args, pq.Array(values))
+		conditions = append(conditions, fmt.Sprintf("%s = ANY($%d)", column, len(args)))
+	}
+	return "WHERE " + strings.Join(conditions, "\nAND "), args
+}
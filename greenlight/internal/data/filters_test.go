@@ -0,0 +1,48 @@
+package data
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/fara/fakeauto/internal/validator"
+)
+
+func TestValidateFiltersCursor(t *testing.T) {
+	valid := cursor{Sort: "-horsepower,name,created_at", Values: []any{150.5, "Ford", "2023-01-02T03:04:05Z"}, ID: 7}
+	tests := []struct {
+		name   string
+		sort   string
+		cursor string
+		ok     bool
+	}{
+		{"valid", valid.Sort, encodeCursor(valid), true},
+		{"integer column", "cylinders", encodeCursor(cursor{Sort: "cylinders", Values: []any{4}, ID: 7}), true},
+		{"not base64", valid.Sort, "!!!", false},
+		{"not JSON", valid.Sort, base64.RawURLEncoding.EncodeToString([]byte("nope")), false},
+		{"other sort", valid.Sort, encodeCursor(cursor{Sort: "name", Values: []any{"Ford"}, ID: 7}), false},
+		{"too few values", valid.Sort, encodeCursor(cursor{Sort: valid.Sort, Values: []any{150.5, "Ford"}, ID: 7}), false},
+		{"object value", valid.Sort, encodeCursor(cursor{Sort: valid.Sort, Values: []any{map[string]any{"a": 1}, "Ford", "2023-01-02T03:04:05Z"}, ID: 7}), false},
+		{"array value", valid.Sort, encodeCursor(cursor{Sort: valid.Sort, Values: []any{150.5, []any{"Ford"}, "2023-01-02T03:04:05Z"}, ID: 7}), false},
+		{"string for a number", valid.Sort, encodeCursor(cursor{Sort: valid.Sort, Values: []any{"fast", "Ford", "2023-01-02T03:04:05Z"}, ID: 7}), false},
+		{"number for a string", valid.Sort, encodeCursor(cursor{Sort: valid.Sort, Values: []any{150.5, 3, "2023-01-02T03:04:05Z"}, ID: 7}), false},
+		{"null value", valid.Sort, encodeCursor(cursor{Sort: valid.Sort, Values: []any{nil, "Ford", "2023-01-02T03:04:05Z"}, ID: 7}), false},
+		{"bad timestamp", valid.Sort, encodeCursor(cursor{Sort: valid.Sort, Values: []any{150.5, "Ford", "yesterday"}, ID: 7}), false},
+		{"NUL in a string", valid.Sort, encodeCursor(cursor{Sort: valid.Sort, Values: []any{150.5, "Fo\x00rd", "2023-01-02T03:04:05Z"}, ID: 7}), false},
+		{"fraction for an integer", "cylinders", encodeCursor(cursor{Sort: "cylinders", Values: []any{4.5}, ID: 7}), false},
+	}
+	for _, tt := range tests {
+		f := Filters{
+			Page:         1,
+			PageSize:     20,
+			Sort:         tt.sort,
+			SortSafelist: SortSafelist("name", "horsepower", "cylinders", "created_at"),
+			Cursor:       tt.cursor,
+			Record:       &Car{},
+		}
+		v := validator.New()
+		ValidateFilters(v, f)
+		if v.Valid() != tt.ok {
+			t.Errorf("%s: valid = %v, want %v (errors %v)", tt.name, v.Valid(), tt.ok, v.Errors)
+		}
+	}
+}
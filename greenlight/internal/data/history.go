@@ -0,0 +1,301 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The actions recorded in the history of a vehicle. A snapshot holds the state of a
+// record which already existed when the history table was added.
+const (
+	HistoryInsert   = "insert"
+	HistoryUpdate   = "update"
+	HistoryDelete   = "delete"
+	HistoryRestore  = "restore"
+	HistoryPurge    = "purge"
+	HistorySnapshot = "snapshot"
+)
+
+// A HistoryEntry records a single change to a vehicle: who made it and when, the version
+// of the record it produced, and the values of the changed columns before and after.
+// UserID is nil if the change was made by a user who has since been deleted.
+type HistoryEntry struct {
+	ID        int64                      `json:"id"`
+	Version   int32                      `json:"version"`
+	Action    string                     `json:"action"`
+	UserID    *int64                     `json:"user_id"`
+	ChangedAt time.Time                  `json:"changed_at"`
+	OldValues map[string]json.RawMessage `json:"old_values,omitempty"`
+	NewValues map[string]json.RawMessage `json:"new_values,omitempty"`
+}
+
+// The HistorySortSafelist holds the sort keys accepted by the history endpoints. The
+// entry id orders the changes in the order they were made.
+var HistorySortSafelist = SortSafelist("id")
+
+// A rowChange describes a statement which inserts, updates or deletes a single row of a
+// vehicle table, to be run by applyChange() together with its history entry.
+type rowChange struct {
+	table  string
+	action string
+	userID int64
+	// lock selects the row as it was before the change as to_jsonb, and locks it with
+	// FOR UPDATE. It is left empty for inserts. If it matches no rows, applyChange()
+	// returns missing.
+	lock     string
+	lockArgs []any
+	missing  error
+	// stmt makes the change and returns the row as it is afterwards as to_jsonb (or
+	// NULL if the row is gone), followed by any values to scan into dest.
+	stmt string
+	args []any
+	dest []any
+}
+
+// The applyChange() function runs a rowChange in the given transaction and appends the
+// matching entry to the history table, so a change is never made without being
+// recorded. The version in the history entry is read from the row itself.
+func applyChange(ctx context.Context, tx *sql.Tx, c rowChange) error {
+	var before, after []byte
+	if c.lock != "" {
+		err := tx.QueryRowContext(ctx, c.lock, c.lockArgs...).Scan(&before)
+		if err != nil {
+			switch {
+			case errors.Is(err, sql.ErrNoRows):
+				return c.missing
+			default:
+				return err
+			}
+		}
+	}
+
+	err := tx.QueryRowContext(ctx, c.stmt, c.args...).Scan(append([]any{&after}, c.dest...)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return c.missing
+		default:
+			return err
+		}
+	}
+
+	row := after
+	if row == nil {
+		row = before
+	}
+	var key struct {
+		ID      int64 `json:"id"`
+		Version int32 `json:"version"`
+	}
+	if err := json.Unmarshal(row, &key); err != nil {
+		return err
+	}
+
+	oldValues, newValues, err := diffRows(before, after)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO vehicle_history (vehicle_type, vehicle_id, version, action, user_id, old_values, new_values)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	// A zero user id means the change wasn't made by a signed-in user, which we record
+	// as NULL rather than breaking the foreign key.
+	var userID any
+	if c.userID > 0 {
+		userID = c.userID
+	}
+	_, err = tx.ExecContext(ctx, query, c.table, key.ID, key.Version, c.action, userID, oldValues, newValues)
+	return err
+}
+
+// The applyChanges() function runs one or more row changes in a single transaction,
+// committing only if all of them succeed.
+func applyChanges(db *sql.DB, timeout time.Duration, changes ...rowChange) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback()
+
+	for _, c := range changes {
+		if err := applyChange(ctx, tx, c); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// The diffRows() function compares a row before and after a change, both as to_jsonb
+// objects, and returns the old and new values of the columns which changed as JSON
+// strings (or nil, for a NULL column in the history table). For an insert the new
+// values are the whole row, and for a purge the old values are. The version isn't
+// included, since it is stored in its own column.
+func diffRows(before, after []byte) (oldValues, newValues any, err error) {
+	var oldRow, newRow map[string]json.RawMessage
+	if before != nil {
+		if err := json.Unmarshal(before, &oldRow); err != nil {
+			return nil, nil, err
+		}
+	}
+	if after != nil {
+		if err := json.Unmarshal(after, &newRow); err != nil {
+			return nil, nil, err
+		}
+	}
+	delete(oldRow, "version")
+	delete(newRow, "version")
+
+	if oldRow != nil && newRow != nil {
+		for column, value := range newRow {
+			if bytes.Equal(value, oldRow[column]) {
+				delete(oldRow, column)
+				delete(newRow, column)
+			}
+		}
+	}
+
+	encode := func(values map[string]json.RawMessage) (any, error) {
+		if values == nil {
+			return nil, nil
+		}
+		js, err := json.Marshal(values)
+		return string(js), err
+	}
+	if oldValues, err = encode(oldRow); err != nil {
+		return nil, nil, err
+	}
+	if newValues, err = encode(newRow); err != nil {
+		return nil, nil, err
+	}
+	return oldValues, newValues, nil
+}
+
+// The history() function returns a page of the history entries for a vehicle. It
+// returns ErrRecordNotFound if the vehicle has no history at all, which means it never
+// existed.
+func history(db *sql.DB, table string, id int64, filters Filters) ([]*HistoryEntry, Metadata, error) {
+	if id < 1 {
+		return nil, Metadata{}, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(`
+SELECT count(*) OVER(), id, version, action, user_id, changed_at, old_values, new_values
+FROM vehicle_history
+WHERE vehicle_type = $1 AND vehicle_id = $2
+ORDER BY %s
+LIMIT $3 OFFSET $4`, filters.orderBy())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, query, table, id, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	entries := []*HistoryEntry{}
+	for rows.Next() {
+		var entry HistoryEntry
+		var oldValues, newValues []byte
+		err := rows.Scan(&totalRecords, &entry.ID, &entry.Version, &entry.Action, &entry.UserID, &entry.ChangedAt, &oldValues, &newValues)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		if err := unmarshalValues(oldValues, &entry.OldValues); err != nil {
+			return nil, Metadata{}, err
+		}
+		if err := unmarshalValues(newValues, &entry.NewValues); err != nil {
+			return nil, Metadata{}, err
+		}
+		entries = append(entries, &entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	if totalRecords == 0 && filters.Page == 1 {
+		return nil, Metadata{}, ErrRecordNotFound
+	}
+	return entries, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+func unmarshalValues(js []byte, dst *map[string]json.RawMessage) error {
+	if js == nil {
+		return nil
+	}
+	return json.Unmarshal(js, dst)
+}
+
+// The reconstruct() function rebuilds the state of a vehicle at a past version by
+// replaying its history: starting from the last insert or snapshot at or before that
+// version, the new values of each later change are applied in turn. The columns are
+// decoded into the record's fields() map. If the history doesn't reach back to that
+// version, ErrRecordNotFound is returned.
+func reconstruct(db *sql.DB, table string, id int64, version int32, fields map[string]any) error {
+	if id < 1 || version < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+SELECT version, action, new_values
+FROM vehicle_history
+WHERE vehicle_type = $1 AND vehicle_id = $2 AND version <= $3
+ORDER BY id ASC`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, query, table, id, version)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var state map[string]json.RawMessage
+	found := false
+	for rows.Next() {
+		var entryVersion int32
+		var action string
+		var newValues []byte
+		if err := rows.Scan(&entryVersion, &action, &newValues); err != nil {
+			return err
+		}
+		var values map[string]json.RawMessage
+		if err := unmarshalValues(newValues, &values); err != nil {
+			return err
+		}
+		switch {
+		case action == HistoryInsert || action == HistorySnapshot:
+			state = values
+		case state != nil:
+			for column, value := range values {
+				state[column] = value
+			}
+		}
+		found = found || (entryVersion == version && state != nil)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if !found {
+		return ErrRecordNotFound
+	}
+
+	for column, value := range state {
+		if ptr, ok := fields[column]; ok {
+			if err := json.Unmarshal(value, ptr); err != nil {
+				return err
+			}
+		}
+	}
+	*fields["version"].(*int32) = version
+	return nil
+}
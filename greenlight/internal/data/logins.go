@@ -0,0 +1,212 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// The kinds of login throttle: failed sign in attempts are counted both for the account
+// being signed in to, identified by its lower-cased email address, and for the client's
+// IP address.
+const (
+	ThrottleAccount = "account"
+	ThrottleIP      = "ip"
+)
+
+// A LoginPolicy sets how failed sign in attempts are throttled. After each failure the
+// next attempt has to wait BaseDelay, doubling with every further failure, and once
+// MaxFailures attempts have failed the subject is locked out for Lockout. Failures
+// older than Lockout are forgotten.
+type LoginPolicy struct {
+	MaxFailures int
+	BaseDelay   time.Duration
+	Lockout     time.Duration
+}
+
+// A LoginThrottle holds the failed sign in attempts for an account or IP address.
+type LoginThrottle struct {
+	Kind          string     `json:"kind"`
+	Subject       string     `json:"subject"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
+
+// The RetryAfter() method returns how long the subject must wait before its next sign
+// in attempt under the policy p, or zero if it may try now.
+func (t *LoginThrottle) RetryAfter(p LoginPolicy, now time.Time) time.Duration {
+	if t.LockedUntil != nil && t.LockedUntil.After(now) {
+		return t.LockedUntil.Sub(now)
+	}
+	if t.Failures == 0 || now.Sub(t.LastFailureAt) > p.Lockout {
+		return 0
+	}
+	delay := p.Lockout
+	if t.Failures < 32 && p.BaseDelay<<(t.Failures-1) < delay {
+		delay = p.BaseDelay << (t.Failures - 1)
+	}
+	if next := t.LastFailureAt.Add(delay); next.After(now) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+// Define the LoginThrottleModel type.
+type LoginThrottleModel struct {
+	DB *sql.DB
+}
+
+// A LoginSubject is an account or IP address which sign in attempts are counted
+// against, along with the policy it is throttled under.
+type LoginSubject struct {
+	Kind    string
+	Subject string
+	Policy  LoginPolicy
+}
+
+// The Reserve() method claims a sign in attempt against all of subjects at once, before
+// the password is checked. If any of them has to wait, nothing changes and the longest
+// wait is returned. Otherwise the attempt is counted as a failure for each subject
+// straight away, so that concurrent attempts each see the ones before them and are held
+// back by the delay, rather than all getting past the check before any failure has been
+// recorded. The rows are locked in the order given, so callers must always pass the
+// subjects in the same order. An attempt which fails is then passed to RecordFailure(),
+// and one which doesn't is given back with Release() or Reset().
+func (m LoginThrottleModel) Reserve(subjects []LoginSubject) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback()
+
+	var retryAfter time.Duration
+	now := time.Now()
+	for _, s := range subjects {
+		// Make sure there is a row to lock, even for a subject with no failures yet.
+		query := `
+		INSERT INTO login_throttles (kind, subject)
+		VALUES ($1, $2)
+		ON CONFLICT (kind, subject) DO NOTHING`
+		_, err = tx.ExecContext(ctx, query, s.Kind, s.Subject)
+		if err != nil {
+			return 0, err
+		}
+		query = `
+		SELECT failures, last_failure_at, locked_until
+		FROM login_throttles
+		WHERE kind = $1 AND subject = $2
+		FOR UPDATE`
+		throttle := LoginThrottle{Kind: s.Kind, Subject: s.Subject}
+		err = tx.QueryRowContext(ctx, query, s.Kind, s.Subject).Scan(&throttle.Failures, &throttle.LastFailureAt, &throttle.LockedUntil)
+		if err != nil {
+			return 0, err
+		}
+		if wait := throttle.RetryAfter(s.Policy, now); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if retryAfter > 0 {
+		return retryAfter, nil
+	}
+
+	for _, s := range subjects {
+		query := `
+		UPDATE login_throttles
+		SET failures = CASE
+			WHEN last_failure_at < NOW() - make_interval(secs => $3) THEN 1
+			ELSE failures + 1
+		END,
+		last_failure_at = NOW()
+		WHERE kind = $1 AND subject = $2`
+		_, err = tx.ExecContext(ctx, query, s.Kind, s.Subject, s.Policy.Lockout.Seconds())
+		if err != nil {
+			return 0, err
+		}
+	}
+	return 0, tx.Commit()
+}
+
+// The RecordFailure() method records that an attempt claimed with Reserve() failed.
+// Reserve() has already counted it, so all that is left is to lock the subject out once
+// the policy's MaxFailures is reached, after which its count starts again from zero.
+// In that case locked is true, so the caller can act on it.
+func (m LoginThrottleModel) RecordFailure(kind, subject string, p LoginPolicy) (throttle *LoginThrottle, locked bool, err error) {
+	query := `
+	UPDATE login_throttles
+	SET failures = 0, locked_until = NOW() + make_interval(secs => $4)
+	WHERE kind = $1 AND subject = $2 AND failures >= $3
+	RETURNING failures, last_failure_at, locked_until`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	throttle = &LoginThrottle{Kind: kind, Subject: subject}
+	err = m.DB.QueryRowContext(ctx, query, kind, subject, p.MaxFailures, p.Lockout.Seconds()).Scan(&throttle.Failures, &throttle.LastFailureAt, &throttle.LockedUntil)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return throttle, true, nil
+}
+
+// The Release() method gives back an attempt claimed with Reserve() which didn't fail,
+// so that it no longer counts against the subject.
+func (m LoginThrottleModel) Release(kind, subject string) error {
+	query := `
+	UPDATE login_throttles
+	SET failures = GREATEST(failures - 1, 0)
+	WHERE kind = $1 AND subject = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, kind, subject)
+	return err
+}
+
+// The Reset() method forgets the failed attempts for an account or IP address, and
+// lifts any lockout.
+func (m LoginThrottleModel) Reset(kind, subject string) error {
+	query := `
+	DELETE FROM login_throttles
+	WHERE kind = $1 AND subject = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, kind, subject)
+	return err
+}
+
+// The GetActive() method returns the accounts and IP addresses which are locked out or
+// have failed attempts within the last window, most recent failure first. LockedUntil
+// is only set for those which are still locked out.
+func (m LoginThrottleModel) GetActive(window time.Duration) ([]*LoginThrottle, error) {
+	query := `
+	SELECT kind, subject, failures, last_failure_at, CASE WHEN locked_until > NOW() THEN locked_until END
+	FROM login_throttles
+	WHERE locked_until > NOW() OR (failures > 0 AND last_failure_at > NOW() - make_interval(secs => $1))
+	ORDER BY last_failure_at DESC`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, window.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	throttles := []*LoginThrottle{}
+	for rows.Next() {
+		var throttle LoginThrottle
+		err := rows.Scan(&throttle.Kind, &throttle.Subject, &throttle.Failures, &throttle.LastFailureAt, &throttle.LockedUntil)
+		if err != nil {
+			return nil, err
+		}
+		throttles = append(throttles, &throttle)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return throttles, nil
+}
@@ -16,7 +16,11 @@ var (
 // kind of enveloping
 type Models struct {
 	Permissions PermissionModel // Add a new Permissions field.
+	Roles       RoleModel
 	Tokens      TokenModel
+	APIKeys     APIKeyModel
+	TOTP        TOTPModel
+	Logins      LoginThrottleModel
 	Users       UserModel
 	Cars        CarModel
 	MotorBikes  MotorbikeModel
@@ -25,7 +29,11 @@ type Models struct {
 func NewModels(db *sql.DB) Models {
 	return Models{
 		Permissions: PermissionModel{DB: db}, // Initialize a new PermissionModel instance.
+		Roles:       RoleModel{DB: db},
 		Tokens:      TokenModel{DB: db},
+		APIKeys:     APIKeyModel{DB: db},
+		TOTP:        TOTPModel{DB: db},
+		Logins:      LoginThrottleModel{DB: db},
 		Users:       UserModel{DB: db},
 		Cars:        CarModel{DB: db},
 		MotorBikes:  MotorbikeModel{DB: db},
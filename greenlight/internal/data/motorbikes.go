@@ -5,7 +5,10 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
+
+	"github.com/fara/fakeauto/internal/validator"
 )
 
 type Motorbike struct {
@@ -22,47 +25,137 @@ type Motorbike struct {
 	Origin       string    `json:"origin"`
 	Version      int32     `json:"version"` // The version number starts at 1 and will be incremented each
 	// time the movie information is updated
+	DeletedAt *time.Time `json:"deleted_at,omitempty"` // When the record was moved to the trash, nil if it is live
+	CreatedBy *int64     `json:"-"`                    // The user who created the record, nil if they have since been deleted
+}
+
+// The fields() method maps the columns of the motorbikes table to pointers at the
+// matching Motorbike fields, so that a column can be looked up by name.
+func (motorbike *Motorbike) fields() map[string]any {
+	return map[string]any{
+		"id":           &motorbike.ID,
+		"created_at":   &motorbike.CreatedAt,
+		"name":         &motorbike.Name,
+		"horsepower":   &motorbike.Horsepower,
+		"type":         &motorbike.Type,
+		"weight":       &motorbike.Weight,
+		"third_place":  &motorbike.ThirdPlace,
+		"cylinders":    &motorbike.Cylinders,
+		"acceleration": &motorbike.Acceleration,
+		"displacement": &motorbike.Displacement,
+		"origin":       &motorbike.Origin,
+		"version":      &motorbike.Version,
+		"deleted_at":   &motorbike.DeletedAt,
+		"created_by":   &motorbike.CreatedBy,
+	}
+}
+
+// ValidateMotorbike checks the fields of a motorbike before it is inserted or updated.
+func ValidateMotorbike(v *validator.Validator, motorbike *Motorbike) {
+	v.Check(motorbike.Name != "", "name", "must be provided")
+	v.Check(len(motorbike.Name) <= 500, "name", "must not be more than 500 bytes long")
+
+	v.Check(motorbike.Horsepower != 0, "horsepower", "must be provided")
+	v.Check(motorbike.Horsepower <= 2000, "horsepower", "must be less than 2000")
+
+	v.Check(motorbike.Type != "", "type", "must be provided")
+	v.Check(len(motorbike.Type) <= 50, "type", "must not be more than 50 bytes long")
+
+	v.Check(motorbike.Weight != 0, "weight", "must be provided")
+	v.Check(motorbike.Weight <= 1000, "weight", "must be less than 1000kg")
+
+	v.Check(motorbike.Cylinders != 0, "cylinders", "must be provided")
+	v.Check(motorbike.Cylinders%2 == 0, "cylinders", "must be 2, 4 etc...")
+
+	v.Check(motorbike.Acceleration != 0, "acceleration", "must be provided")
+
+	v.Check(motorbike.Displacement != 0, "displacement", "must be provided")
+
+	v.Check(motorbike.Origin != "", "origin", "must be provided")
+	v.Check(len(motorbike.Origin) <= 50, "origin", "must not be more than 50 bytes long")
+}
+
+// The columns of the motorbikes table, in table order.
+var motorbikeColumns = []string{"id", "created_at", "name", "horsepower", "type", "weight", "third_place",
+	"cylinders", "acceleration", "displacement", "origin", "version", "deleted_at", "created_by"}
+
+// The Project() method returns a map holding only the named fields of the motorbike, for
+// responses where the client asked for a sparse fieldset.
+func (motorbike *Motorbike) Project(names []string) map[string]any {
+	return project(motorbike.fields(), names)
 }
 
 type MotorbikeModel struct {
 	DB *sql.DB
 }
 
-func (m MotorbikeModel) Insert(motorbike *Motorbike) error {
+// The insertChange() method describes the insert of a motorbike, which fills in the id,
+// created_at and version of the motorbike once it has been applied.
+func (m MotorbikeModel) insertChange(motorbike *Motorbike, userID int64) rowChange {
 	query := `
-		INSERT INTO motorbikes(name,horsepower,type,weight,third_place,cylinders,acceleration,displacement,origin)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-		RETURNING id, created_at, version`
+		INSERT INTO motorbikes(name,horsepower,type,weight,third_place,cylinders,acceleration,displacement,origin,created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING to_jsonb(motorbikes), id, created_at, version`
+
+	args := []any{
+		motorbike.Name,
+		motorbike.Horsepower,
+		motorbike.Type,
+		motorbike.Weight,
+		motorbike.ThirdPlace,
+		motorbike.Cylinders,
+		motorbike.Acceleration,
+		motorbike.Displacement,
+		motorbike.Origin,
+		userID,
+	}
+	motorbike.CreatedBy = &userID
 
-	return m.DB.QueryRow(query, &motorbike.Name, &motorbike.Horsepower, &motorbike.Type, &motorbike.Weight, &motorbike.ThirdPlace, &motorbike.Cylinders, &motorbike.Acceleration, &motorbike.Displacement, &motorbike.Origin).Scan(&motorbike.ID, &motorbike.CreatedAt, &motorbike.Version)
+	return rowChange{
+		table:  "motorbikes",
+		action: HistoryInsert,
+		userID: userID,
+		stmt:   query,
+		args:   args,
+		dest:   []any{&motorbike.ID, &motorbike.CreatedAt, &motorbike.Version},
+	}
 }
 
-func (m MotorbikeModel) Get(id int64) (*Motorbike, error) {
+// Insert() adds a new motorbike, recording the user who added it as its owner and in the
+// history.
+func (m MotorbikeModel) Insert(motorbike *Motorbike, userID int64) error {
+	return applyChanges(m.DB, 3*time.Second, m.insertChange(motorbike, userID))
+}
+
+// InsertMany() inserts a batch of motorbikes in a single transaction, filling in the
+// id, created_at and version of each one. Either every motorbike is inserted or, if any
+// insert fails, none of them are.
+func (m MotorbikeModel) InsertMany(motorbikes []*Motorbike, userID int64) error {
+	changes := make([]rowChange, len(motorbikes))
+	for i, motorbike := range motorbikes {
+		changes[i] = m.insertChange(motorbike, userID)
+	}
+	// Allow a longer timeout than usual, since a batch can hold thousands of rows.
+	return applyChanges(m.DB, 30*time.Second, changes...)
+}
+
+// Get() fetches a live motorbike by id, ignoring any in the trash. If any fields are
+// given, only those columns (plus the id and version, which make up the ETag) are read
+// from the database and the remaining fields are left at their zero values.
+func (m MotorbikeModel) Get(id int64, fields ...string) (*Motorbike, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
-	query := `
-		SELECT *
+	columns := selectColumns(motorbikeColumns, fields, "id", "version")
+	query := fmt.Sprintf(`
+		SELECT %s
 		FROM motorbikes
-		WHERE id = $1`
+		WHERE id = $1 AND deleted_at IS NULL`, strings.Join(columns, ", "))
 
 	var motorbike Motorbike
 
-	err := m.DB.QueryRow(query, id).Scan(
-		&motorbike.ID,
-		&motorbike.CreatedAt,
-		&motorbike.Name,
-		&motorbike.Horsepower,
-		&motorbike.Type,
-		&motorbike.Weight,
-		&motorbike.ThirdPlace,
-		&motorbike.Cylinders,
-		&motorbike.Acceleration,
-		&motorbike.Displacement,
-		&motorbike.Origin,
-		&motorbike.Version,
-	)
+	err := m.DB.QueryRow(query, id).Scan(scanDest(motorbike.fields(), columns)...)
 
 	if err != nil {
 		switch {
@@ -77,14 +170,23 @@ func (m MotorbikeModel) Get(id int64) (*Motorbike, error) {
 
 }
 
-func (m MotorbikeModel) Update(motorbike *Motorbike) error {
+// Update() saves the changes to a motorbike, as long as it is still live and at the version
+// the caller read. The old and new values of the changed fields are recorded in the
+// history.
+func (m MotorbikeModel) Update(motorbike *Motorbike, userID int64) error {
+	lock := `
+		SELECT to_jsonb(motorbikes)
+		FROM motorbikes
+		WHERE id = $1 AND version = $2 AND deleted_at IS NULL
+		FOR UPDATE`
+
 	query := `
 		UPDATE motorbikes
 		SET name = $1, horsepower = $2, type = $3, weight = $4, third_place = $5, cylinders = $6, acceleration = $7, displacement = $8, origin = $9, version = version + 1
-		WHERE id = $10 AND version = $11
-		RETURNING version`
+		WHERE id = $10
+		RETURNING to_jsonb(motorbikes), version`
 
-	args := []interface{}{
+	args := []any{
 		motorbike.Name,
 		motorbike.Horsepower,
 		motorbike.Type,
@@ -95,58 +197,175 @@ func (m MotorbikeModel) Update(motorbike *Motorbike) error {
 		motorbike.Displacement,
 		motorbike.Origin,
 		motorbike.ID,
-		motorbike.Version,
 	}
 
-	err := m.DB.QueryRow(query, args...).Scan(&motorbike.Version)
+	return applyChanges(m.DB, 3*time.Second, rowChange{
+		table:    "motorbikes",
+		action:   HistoryUpdate,
+		userID:   userID,
+		lock:     lock,
+		lockArgs: []any{motorbike.ID, motorbike.Version},
+		missing:  ErrEditConflict,
+		stmt:     query,
+		args:     args,
+		dest:     []any{&motorbike.Version},
+	})
+}
+
+// Delete() moves a motorbike to the trash by setting its deleted_at timestamp, but only
+// if it is still at the given version, so a client can't delete a record which was
+// changed after it last read it. If no live row matches we return ErrEditConflict, and
+// the caller is expected to have checked that the record exists beforehand.
+func (m MotorbikeModel) Delete(id int64, version int32, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	lock := `
+		SELECT to_jsonb(motorbikes)
+		FROM motorbikes
+		WHERE id = $1 AND version = $2 AND deleted_at IS NULL
+		FOR UPDATE`
+
+	query := `
+		UPDATE motorbikes
+		SET deleted_at = NOW(), version = version + 1
+		WHERE id = $1
+		RETURNING to_jsonb(motorbikes)`
+
+	return applyChanges(m.DB, 3*time.Second, rowChange{
+		table:    "motorbikes",
+		action:   HistoryDelete,
+		userID:   userID,
+		lock:     lock,
+		lockArgs: []any{id, version},
+		missing:  ErrEditConflict,
+		stmt:     query,
+		args:     []any{id},
+	})
+}
+
+// GetOwner() returns the id of the user who created a motorbike, whether it is live or in
+// the trash, or nil if that isn't known.
+func (m MotorbikeModel) GetOwner(id int64) (*int64, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+	query := `
+		SELECT created_by
+		FROM motorbikes
+		WHERE id = $1`
+	var createdBy *int64
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(&createdBy)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
+			return nil, ErrRecordNotFound
 		default:
-			return err
+			return nil, err
 		}
 	}
-	return nil
+	return createdBy, nil
 }
 
-func (m MotorbikeModel) Delete(id int64) error {
+// Restore() moves a motorbike out of the trash, returning ErrRecordNotFound if there is
+// no such motorbike in the trash.
+func (m MotorbikeModel) Restore(id int64, userID int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
 
-	query := `
-		DELETE FROM motorbikes
-		WHERE id = $1`
+	lock := `
+		SELECT to_jsonb(motorbikes)
+		FROM motorbikes
+		WHERE id = $1 AND deleted_at IS NOT NULL
+		FOR UPDATE`
 
-	result, err := m.DB.Exec(query, id)
-	if err != nil {
-		return err
-	}
+	query := `
+		UPDATE motorbikes
+		SET deleted_at = NULL, version = version + 1
+		WHERE id = $1
+		RETURNING to_jsonb(motorbikes)`
 
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return err
-	}
+	return applyChanges(m.DB, 3*time.Second, rowChange{
+		table:    "motorbikes",
+		action:   HistoryRestore,
+		userID:   userID,
+		lock:     lock,
+		lockArgs: []any{id},
+		missing:  ErrRecordNotFound,
+		stmt:     query,
+		args:     []any{id},
+	})
+}
 
-	if rowsAffected == 0 {
+// Purge() permanently deletes a motorbike. Only records which are already in the trash
+// can be purged, so a live record always has to be deleted first. Its history is kept.
+func (m MotorbikeModel) Purge(id int64, userID int64) error {
+	if id < 1 {
 		return ErrRecordNotFound
 	}
 
-	return nil
+	lock := `
+		SELECT to_jsonb(motorbikes)
+		FROM motorbikes
+		WHERE id = $1 AND deleted_at IS NOT NULL
+		FOR UPDATE`
+
+	query := `
+		DELETE FROM motorbikes
+		WHERE id = $1
+		RETURNING NULL::jsonb`
+
+	return applyChanges(m.DB, 3*time.Second, rowChange{
+		table:    "motorbikes",
+		action:   HistoryPurge,
+		userID:   userID,
+		lock:     lock,
+		lockArgs: []any{id},
+		missing:  ErrRecordNotFound,
+		stmt:     query,
+		args:     []any{id},
+	})
 }
 
-func (m MotorbikeModel) GetAll(name string, filters Filters) ([]*Motorbike, Metadata, error) {
+// History() returns a page of the changes made to a motorbike, including those made while it
+// was in the trash and after it was purged.
+func (m MotorbikeModel) History(id int64, filters Filters) ([]*HistoryEntry, Metadata, error) {
+	return history(m.DB, "motorbikes", id, filters)
+}
 
+// GetVersion() reconstructs a motorbike as it was at a past version from its history. It
+// returns ErrRecordNotFound if the motorbike never reached that version, or if the history
+// doesn't go back that far.
+func (m MotorbikeModel) GetVersion(id int64, version int32) (*Motorbike, error) {
+	var motorbike Motorbike
+	err := reconstruct(m.DB, "motorbikes", id, version, motorbike.fields())
+	if err != nil {
+		return nil, err
+	}
+	return &motorbike, nil
+}
+
+func (m MotorbikeModel) GetAll(search SearchFilters, filters Filters, fields ...string) ([]*Motorbike, Metadata, error) {
+
+	// Compile the search filters into the WHERE clause and its arguments.
+	where, args := search.where()
+	// Add the keyset condition when the client is paging with a cursor.
+	seek, args := filters.seek(args)
+	// Read only the requested fields, plus the id and sort columns the cursors need.
+	columns := selectColumns(motorbikeColumns, fields, append(filters.sortColumns(), "id")...)
 	query := fmt.Sprintf(`
-SELECT count(*) OVER(), id, created_at, name, horsepower, type, weight,third_place,cylinders,acceleration,displacement,origin, version
+SELECT count(*) OVER(), %s
 FROM motorbikes
-WHERE (to_tsvector('simple', name) @@ plainto_tsquery('simple', $1) OR $1 = '')
-ORDER BY %s %s, id ASC
-LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
+%s %s
+ORDER BY %s
+LIMIT $%d OFFSET $%d`, strings.Join(columns, ", "), where, seek, filters.orderBy(), len(args)+1, len(args)+2)
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	args := []any{name, filters.limit(), filters.offset()}
+	args = append(args, filters.limit(), filters.offset())
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err // Update this to return an empty Metadata struct.
@@ -157,21 +376,10 @@ LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
 	motorbikes := []*Motorbike{}
 	for rows.Next() {
 		var motorbike Motorbike
-		err := rows.Scan(
-			&totalRecords, // Scan the count from the window function into totalRecords.
-			&motorbike.ID,
-			&motorbike.CreatedAt,
-			&motorbike.Name,
-			&motorbike.Horsepower,
-			&motorbike.Type,
-			&motorbike.Weight,
-			&motorbike.ThirdPlace,
-			&motorbike.Cylinders,
-			&motorbike.Acceleration,
-			&motorbike.Displacement,
-			&motorbike.Origin,
-			&motorbike.Version,
-		)
+		// Scan the count from the window function into totalRecords, followed by the
+		// selected columns.
+		dest := append([]any{&totalRecords}, scanDest(motorbike.fields(), columns)...)
+		err := rows.Scan(dest...)
 		if err != nil {
 			return nil, Metadata{}, err // Update this to return an empty Metadata struct.
 		}
@@ -181,8 +389,50 @@ LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
 		return nil, Metadata{}, err // Update this to return an empty Metadata struct.
 	}
 	// Generate a Metadata struct, passing in the total record count and pagination
-	// parameters from the client.
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	// parameters from the client, and trim the page down when paging with a cursor.
+	motorbikes, metadata := paginate(motorbikes, totalRecords, filters, (*Motorbike).fields)
 	// Include the metadata struct when returning.
 	return motorbikes, metadata, nil
 }
+
+// Export() streams every motorbike matching the search filters, in the order given by the
+// filters' sort keys, calling fn for each one as soon as it is read rather than
+// collecting them all in memory. If any fields are given only those columns (and the
+// id) are read. There is no paging and no fixed query timeout, so the export runs for as
+// long as ctx allows; the caller is responsible for any deadline on writing the records
+// out. If fn returns an error the export stops and that error is returned.
+func (m MotorbikeModel) Export(ctx context.Context, search SearchFilters, filters Filters, fn func(*Motorbike) error, fields ...string) error {
+	where, args := search.where()
+	columns := selectColumns(motorbikeColumns, fields, "id")
+	query := fmt.Sprintf(`
+SELECT %s
+FROM motorbikes
+%s
+ORDER BY %s`, strings.Join(columns, ", "), where, filters.orderBy())
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var motorbike Motorbike
+		err := rows.Scan(scanDest(motorbike.fields(), columns)...)
+		if err != nil {
+			return err
+		}
+		if err := fn(&motorbike); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Facets() returns the sidebar counts for the motorbikes matching the search filters:
+// the number of motorbikes per type, origin, third place option and cylinder count,
+// plus a horsepower histogram in 25hp buckets.
+func (m MotorbikeModel) Facets(search SearchFilters) (*Facets, error) {
+	return facets(m.DB, "motorbikes", search,
+		[]string{"type", "origin", "third_place", "cylinders"},
+		map[string]float64{"horsepower": 25},
+	)
+}
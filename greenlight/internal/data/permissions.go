@@ -3,22 +3,28 @@ package data
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"github.com/lib/pq"
+	"strings"
 	"time"
 )
 
 // Define a Permissions slice, which we will use to hold the permission codes (like
-// "movies:read" and "movies:write") for a single user.
-// "movies:read" and "movies:write") for a single user.
+// "cars:read" and "cars:write") for a single user.
 type Permissions []string
 
 // Add a helper method to check whether the Permissions slice contains a specific
-// permission code.
+// permission code. A wildcard code like "cars:*" includes every code which starts with
+// "cars:", such as "cars:read" and "cars:write", except for the ":any" codes which lift
+// the ownership checks. Those have to be granted explicitly.
 func (p Permissions) Include(code string) bool {
 	for i := range p {
 		if code == p[i] {
 			return true
 		}
+		if strings.HasSuffix(p[i], ":*") && strings.HasPrefix(code, strings.TrimSuffix(p[i], "*")) && !strings.HasSuffix(code, ":any") {
+			return true
+		}
 	}
 	return false
 }
@@ -28,25 +34,55 @@ type PermissionModel struct {
 	DB *sql.DB
 }
 
+// The userPermissionCodes query fragment selects the codes of the permissions held by
+// the user whose id is given by %[1]s, whether granted to them directly or through one
+// of their roles. UNION drops the duplicates when a code comes from both.
+const userPermissionCodes = `
+SELECT permissions.code
+FROM permissions
+INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+WHERE users_permissions.user_id = %[1]s
+UNION
+SELECT permissions.code
+FROM permissions
+INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+WHERE users_roles.user_id = %[1]s`
+
 // The GetAllForUser() method returns all permission codes for a specific user in a
-// Permissions slice. The code in this method should feel very familiar --- it uses the
-// standard pattern that we've already seen before for retrieving multiple data rows in
-// an SQL query.
+// Permissions slice, including those granted to them through their roles. The code in
+// this method should feel very familiar --- it uses the standard pattern that we've
+// already seen before for retrieving multiple data rows in an SQL query.
 func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+	return m.getCodes(fmt.Sprintf(userPermissionCodes, "$1"), userID)
+}
+
+// The GetDirectForUser() method returns only the permission codes granted to a user
+// directly, leaving out those which come from their roles.
+func (m PermissionModel) GetDirectForUser(userID int64) (Permissions, error) {
 	query := `
 SELECT permissions.code
 FROM permissions
 INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-INNER JOIN users ON users_permissions.user_id = users.id
-WHERE users.id = $1`
+WHERE users_permissions.user_id = $1
+ORDER BY permissions.code`
+	return m.getCodes(query, userID)
+}
+
+// The GetAll() method returns every permission code which can be granted.
+func (m PermissionModel) GetAll() (Permissions, error) {
+	return m.getCodes(`SELECT code FROM permissions ORDER BY code`)
+}
+
+func (m PermissionModel) getCodes(query string, args ...any) (Permissions, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	rows, err := m.DB.QueryContext(ctx, query, userID)
+	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var permissions Permissions
+	permissions := Permissions{}
 	for rows.Next() {
 		var permission string
 		err := rows.Scan(&permission)
@@ -61,10 +97,29 @@ WHERE users.id = $1`
 	return permissions, nil
 }
 
+// The AddForUser() method grants permissions to a user directly. Codes which the user
+// already holds directly are skipped, and codes which don't exist are ignored.
 func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
 	query := `
 INSERT INTO users_permissions
-SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)`
+SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+ON CONFLICT DO NOTHING`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	return err
+}
+
+// The RemoveForUser() method revokes permissions granted to a user directly. It doesn't
+// touch their roles, so the user keeps any of the permissions which one of their roles
+// grants.
+func (m PermissionModel) RemoveForUser(userID int64, codes ...string) error {
+	query := `
+DELETE FROM users_permissions
+USING permissions
+WHERE users_permissions.permission_id = permissions.id
+AND users_permissions.user_id = $1
+AND permissions.code = ANY($2)`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
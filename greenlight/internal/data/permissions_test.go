@@ -0,0 +1,26 @@
+package data
+
+import "testing"
+
+func TestPermissionsInclude(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions Permissions
+		code        string
+		want        bool
+	}{
+		{"exact code", Permissions{"cars:read"}, "cars:read", true},
+		{"missing code", Permissions{"cars:read"}, "cars:write", false},
+		{"wildcard", Permissions{"cars:*"}, "cars:write", true},
+		{"wildcard for another resource", Permissions{"cars:*"}, "motorbikes:read", false},
+		{"wildcard doesn't include write any", Permissions{"cars:*"}, "cars:write:any", false},
+		{"wildcard doesn't include delete any", Permissions{"cars:*"}, "cars:delete:any", false},
+		{"explicit any code", Permissions{"cars:*", "cars:delete:any"}, "cars:delete:any", true},
+		{"no permissions", nil, "cars:read", false},
+	}
+	for _, tt := range tests {
+		if got := tt.permissions.Include(tt.code); got != tt.want {
+			t.Errorf("%s: %v.Include(%q) = %v, want %v", tt.name, tt.permissions, tt.code, got, tt.want)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"github.com/fara/fakeauto/internal/validator"
@@ -16,8 +17,17 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication" // Include a new authentication scope.
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+	ScopeMFAPending     = "mfa-pending"
+	ScopeEmailChange    = "email-change"
 )
 
+// ErrTokenReused is returned when a refresh token which has already been rotated is
+// presented again. This means the token has most likely been stolen, so the whole token
+// family is revoked.
+var ErrTokenReused = errors.New("refresh token reused")
+
 // Add struct tags to control how the struct appears when encoded to JSON.
 type Token struct {
 	Plaintext string    `json:"token"`
@@ -25,6 +35,8 @@ type Token struct {
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	FamilyID  int64     `json:"-"`
+	Email     string    `json:"-"`
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -88,16 +100,201 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 
 // Insert() adds the data for a specific token to the tokens table.
 func (m TokenModel) Insert(token *Token) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return insertToken(ctx, m.DB, token)
+}
+
+// The insertToken() function inserts a token using either the connection pool or a
+// transaction. Tokens outside a family are stored with a NULL family_id, and tokens
+// other than email change tokens with a NULL email.
+func insertToken(ctx context.Context, db interface {
+	ExecContext(context.Context, string, ...any) (sql.Result, error)
+}, token *Token) error {
 	query := `
-	INSERT INTO tokens (hash, user_id, expiry, scope)
-	VALUES ($1, $2, $3, $4)`
-	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
+	INSERT INTO tokens (hash, user_id, expiry, scope, family_id, email)
+	VALUES ($1, $2, $3, $4, $5, $6)`
+	var familyID, email any
+	if token.FamilyID > 0 {
+		familyID = token.FamilyID
+	}
+	if token.Email != "" {
+		email = token.Email
+	}
+	args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, familyID, email}
+	_, err := db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// The NewPair() method starts a new token family for a user who has just signed in,
+// holding a short-lived authentication token and a long-lived refresh token which can
+// be exchanged for new ones with Rotate(). If authenticationTTL is zero only the refresh
+// token is created, for when authentication tokens are signed JWTs which aren't stored;
+// the family id is then available from the refresh token.
+func (m TokenModel) NewPair(userID int64, authenticationTTL, refreshTTL time.Duration) (authentication, refresh *Token, err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	_, err := m.DB.ExecContext(ctx, query, args...)
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback()
+
+	var familyID int64
+	err = tx.QueryRowContext(ctx, `SELECT nextval('token_families')`).Scan(&familyID)
+	if err != nil {
+		return nil, nil, err
+	}
+	authentication, refresh, err = newPair(ctx, tx, userID, familyID, authenticationTTL, refreshTTL)
+	if err != nil {
+		return nil, nil, err
+	}
+	return authentication, refresh, tx.Commit()
+}
+
+func newPair(ctx context.Context, tx *sql.Tx, userID, familyID int64, authenticationTTL, refreshTTL time.Duration) (authentication, refresh *Token, err error) {
+	refresh, err = generateToken(userID, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	tokens := []*Token{refresh}
+	if authenticationTTL > 0 {
+		authentication, err = generateToken(userID, authenticationTTL, ScopeAuthentication)
+		if err != nil {
+			return nil, nil, err
+		}
+		tokens = append(tokens, authentication)
+	}
+	for _, token := range tokens {
+		token.FamilyID = familyID
+		if err := insertToken(ctx, tx, token); err != nil {
+			return nil, nil, err
+		}
+	}
+	return authentication, refresh, nil
+}
+
+// The Rotate() method exchanges a refresh token for a new authentication token and a new
+// refresh token in the same family. The old refresh token is marked as rotated rather
+// than deleted, so if it is ever presented again we know it has leaked: in that case
+// every token in the family is deleted and ErrTokenReused is returned. An unknown or
+// expired refresh token gives ErrRecordNotFound. As with NewPair(), a zero
+// authenticationTTL creates only the refresh token.
+func (m TokenModel) Rotate(refreshPlaintext string, authenticationTTL, refreshTTL time.Duration) (authentication, refresh *Token, err error) {
+	tokenHash := sha256.Sum256([]byte(refreshPlaintext))
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback()
+
+	query := `
+	SELECT user_id, family_id, rotated_at IS NOT NULL
+	FROM tokens
+	WHERE hash = $1 AND scope = $2 AND expiry > NOW()
+	FOR UPDATE`
+	var userID, familyID int64
+	var rotated bool
+	err = tx.QueryRowContext(ctx, query, tokenHash[:], ScopeRefresh).Scan(&userID, &familyID, &rotated)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	if rotated {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family_id = $1`, familyID)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrTokenReused
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET rotated_at = NOW() WHERE hash = $1`, tokenHash[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	authentication, refresh, err = newPair(ctx, tx, userID, familyID, authenticationTTL, refreshTTL)
+	if err != nil {
+		return nil, nil, err
+	}
+	return authentication, refresh, tx.Commit()
+}
+
+// DeleteFamily() deletes a token along with every other token in its family, which
+// signs out the session it belongs to. A token outside any family is deleted alone.
+func (m TokenModel) DeleteFamily(scope, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+	DELETE FROM tokens
+	WHERE hash = $2 AND scope = $1
+	OR family_id = (SELECT family_id FROM tokens WHERE hash = $2 AND scope = $1)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, scope, tokenHash[:])
+	return err
+}
+
+// DeleteEverythingForUser() deletes all of a user's tokens, whatever their scope, which
+// signs them out everywhere and cancels any pending activation, password reset or email
+// change.
+func (m TokenModel) DeleteEverythingForUser(userID int64) error {
+	query := `
+	DELETE FROM tokens
+	WHERE user_id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, userID)
 	return err
 }
 
+// The NewEmailChange() method creates a token for changing a user's email address to
+// email, to be sent to that address so the user can prove they own it.
+func (m TokenModel) NewEmailChange(userID int64, ttl time.Duration, email string) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeEmailChange)
+	if err != nil {
+		return nil, err
+	}
+	token.Email = email
+	err = m.Insert(token)
+	return token, err
+}
+
+// The GetEmailChange() method returns the unexpired email change token matching the
+// plaintext, including the user id and the new email address, or ErrRecordNotFound.
+func (m TokenModel) GetEmailChange(tokenPlaintext string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+	SELECT user_id, expiry, email
+	FROM tokens
+	WHERE hash = $1 AND scope = $2 AND expiry > NOW()`
+	token := Token{Plaintext: tokenPlaintext, Hash: tokenHash[:], Scope: ScopeEmailChange}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], ScopeEmailChange).Scan(&token.UserID, &token.Expiry, &token.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &token, nil
+}
+
 // DeleteAllForUser() deletes all tokens for a specific user and scope.
 func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	query := `
@@ -108,3 +305,95 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// DeleteSession() deletes every token in one of a user's token families, given its id.
+// It is used to sign out a session whose authentication token isn't stored, such as a
+// signed JWT.
+func (m TokenModel) DeleteSession(userID, familyID int64) error {
+	query := `
+	DELETE FROM tokens
+	WHERE user_id = $1 AND family_id = $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, userID, familyID)
+	return err
+}
+
+// DeleteOtherSessions() signs a user out of every session except the current one, that
+// is the session holding the token currentPlaintext, or else the one with the id
+// currentID. If neither matches a session, as for a request made with an API key, every
+// session is deleted.
+func (m TokenModel) DeleteOtherSessions(userID int64, currentPlaintext string, currentID int64) error {
+	currentHash := sha256.Sum256([]byte(currentPlaintext))
+	query := `
+	DELETE FROM tokens
+	WHERE user_id = $1 AND scope IN ($2, $3) AND hash <> $4
+	AND family_id IS DISTINCT FROM COALESCE((SELECT family_id FROM tokens WHERE hash = $4), $5)`
+	args := []any{userID, ScopeAuthentication, ScopeRefresh, currentHash[:], currentID}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// A Session describes one of a user's signed-in sessions, that is a token family, without
+// the tokens themselves. It lasts until its current refresh token expires, and was last
+// used when any of its tokens was last used. Current is set for the session the request
+// listing the sessions was made from.
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Expiry     time.Time  `json:"expiry"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Current    bool       `json:"current"`
+}
+
+// GetSessionsForUser() returns a user's active sessions, newest first. The session
+// holding the token currentPlaintext, or else the one with the id currentID, is marked
+// as the current one.
+func (m TokenModel) GetSessionsForUser(userID int64, currentPlaintext string, currentID int64) ([]*Session, error) {
+	currentHash := sha256.Sum256([]byte(currentPlaintext))
+	query := `
+	SELECT refresh.family_id, min(family.created_at), refresh.expiry, max(family.last_used_at), bool_or(family.hash = $3) OR refresh.family_id = $4
+	FROM tokens refresh
+	INNER JOIN tokens family ON family.family_id = refresh.family_id
+	WHERE refresh.scope = $1 AND refresh.user_id = $2
+	AND refresh.rotated_at IS NULL AND refresh.expiry > NOW()
+	GROUP BY refresh.family_id, refresh.expiry
+	ORDER BY min(family.created_at) DESC, refresh.family_id DESC`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, ScopeRefresh, userID, currentHash[:], currentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(&session.ID, &session.CreatedAt, &session.Expiry, &session.LastUsedAt, &session.Current)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// Touch() records that a token has just been used. To avoid a write on every request,
+// the last-used time is only updated if it is more than a minute old.
+func (m TokenModel) Touch(scope, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+	UPDATE tokens
+	SET last_used_at = NOW()
+	WHERE scope = $1 AND hash = $2
+	AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, err := m.DB.ExecContext(ctx, query, scope, tokenHash[:])
+	return err
+}
@@ -0,0 +1,227 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Define the errors returned by the TOTPModel. ErrTOTPEnabled is returned when a user
+// who already has two-factor authentication enabled tries to enroll again, and
+// ErrTOTPCodeReused when a code for a time step which has already been used is given.
+var (
+	ErrTOTPEnabled    = errors.New("two-factor authentication already enabled")
+	ErrTOTPCodeReused = errors.New("totp code already used")
+)
+
+// The number of recovery codes generated when two-factor authentication is enabled.
+const recoveryCodeCount = 10
+
+// A TOTP holds a user's two-factor authentication secret. Confirmed is false while the
+// user is still enrolling, and two-factor authentication is only enforced once it is
+// true.
+type TOTP struct {
+	UserID    int64
+	Secret    string
+	Confirmed bool
+	LastStep  int64
+}
+
+// Define the TOTPModel type.
+type TOTPModel struct {
+	DB *sql.DB
+}
+
+// The Get() method returns a user's TOTP secret, or ErrRecordNotFound if they have never
+// started enrolling.
+func (m TOTPModel) Get(userID int64) (*TOTP, error) {
+	query := `
+	SELECT user_id, secret, confirmed_at IS NOT NULL, last_step
+	FROM user_totp
+	WHERE user_id = $1`
+	var totp TOTP
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&totp.UserID, &totp.Secret, &totp.Confirmed, &totp.LastStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &totp, nil
+}
+
+// The Enabled() method reports whether a user has two-factor authentication enabled.
+func (m TOTPModel) Enabled(userID int64) (bool, error) {
+	totp, err := m.Get(userID)
+	switch {
+	case errors.Is(err, ErrRecordNotFound):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return totp.Confirmed, nil
+}
+
+// The Enroll() method stores a new, unconfirmed secret for a user, replacing any from an
+// earlier enrollment which was never confirmed. It returns ErrTOTPEnabled if the user
+// has already confirmed a secret.
+func (m TOTPModel) Enroll(userID int64, secret string) error {
+	query := `
+	INSERT INTO user_totp (user_id, secret)
+	VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE
+	SET secret = EXCLUDED.secret, created_at = NOW(), last_step = 0
+	WHERE user_totp.confirmed_at IS NULL`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrTOTPEnabled
+	}
+	return nil
+}
+
+// The Confirm() method enables two-factor authentication for a user once they have
+// given a valid code for the time step step, and returns a fresh set of recovery codes.
+// The plaintext codes are only available here; just their hashes are stored.
+func (m TOTPModel) Confirm(userID, step int64) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback()
+
+	query := `
+	UPDATE user_totp
+	SET confirmed_at = NOW(), last_step = $2
+	WHERE user_id = $1 AND confirmed_at IS NULL`
+	result, err := tx.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return nil, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rowsAffected == 0 {
+		return nil, ErrTOTPEnabled
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		randomBytes := make([]byte, 5)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(randomBytes))
+		codes[i] = code[:4] + "-" + code[4:]
+		_, err = tx.ExecContext(ctx, `INSERT INTO totp_recovery_codes (user_id, hash) VALUES ($1, $2)`, userID, hashRecoveryCode(code))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, tx.Commit()
+}
+
+// The hashRecoveryCode() function hashes a recovery code, ignoring case, spaces and
+// dashes, so the code can be typed in however the user likes.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+// The UseStep() method records that the code for the time step step has been used. It
+// returns ErrTOTPCodeReused if that step, or a later one, has already been used.
+func (m TOTPModel) UseStep(userID, step int64) error {
+	query := `
+	UPDATE user_totp
+	SET last_step = $2
+	WHERE user_id = $1 AND last_step < $2`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrTOTPCodeReused
+	}
+	return nil
+}
+
+// The UseRecoveryCode() method marks one of a user's unused recovery codes as used. It
+// returns ErrRecordNotFound if the code doesn't match any of them.
+func (m TOTPModel) UseRecoveryCode(userID int64, code string) error {
+	query := `
+	UPDATE totp_recovery_codes
+	SET used_at = NOW()
+	WHERE user_id = $1 AND hash = $2 AND used_at IS NULL`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// The Delete() method turns off two-factor authentication for a user, removing their
+// secret and recovery codes.
+func (m TOTPModel) Delete(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		`DELETE FROM totp_recovery_codes WHERE user_id = $1`,
+		`DELETE FROM user_totp WHERE user_id = $1`,
+	} {
+		if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/fara/fakeauto/internal/validator"
@@ -29,6 +30,8 @@ type User struct {
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
 	Version   int       `json:"-"`
+	// DeactivatedAt is set when an administrator has deactivated the user's account.
+	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"`
 }
 
 // Check if a User instance is the AnonymousUser.
@@ -140,7 +143,7 @@ func (m UserModel) Insert(user *User) error {
 // return one record (or none at all, in which case we return a ErrRecordNotFound error).
 func (m UserModel) GetByEmail(email string) (*User, error) {
 	query := `
-	SELECT id, created_at, name, email, password_hash, activated, version
+	SELECT id, created_at, name, email, password_hash, activated, version, deactivated_at
 	FROM users
 	WHERE email = $1`
 	var user User
@@ -154,6 +157,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&user.DeactivatedAt,
 	)
 	if err != nil {
 		switch {
@@ -208,7 +212,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 	// Set up the SQL query.
 	query := `
-	SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+	SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version, users.deactivated_at
 	FROM users
 	INNER JOIN tokens
 	ON users.id = tokens.user_id
@@ -233,6 +237,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.Password.hash,
 		&user.Activated,
 		&user.Version,
+		&user.DeactivatedAt,
 	)
 	if err != nil {
 		switch {
@@ -246,26 +251,29 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 	return &user, nil
 }
 
-func (u UserModel) Get(id int64) (*User, error) {
+// The Get() method retrieves a user by their id, returning ErrRecordNotFound if there
+// is no such user.
+func (m UserModel) Get(id int64) (*User, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
-
 	query := `
-		SELECT *
-		FROM user
-		WHERE id = $1`
-
+	SELECT id, created_at, name, email, password_hash, activated, version, deactivated_at
+	FROM users
+	WHERE id = $1`
 	var user User
-
-	err := u.DB.QueryRow(query, id).Scan(
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
 		&user.ID,
 		&user.CreatedAt,
 		&user.Name,
 		&user.Email,
-		&user.Password,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Version,
+		&user.DeactivatedAt,
 	)
-
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -274,7 +282,116 @@ func (u UserModel) Get(id int64) (*User, error) {
 			return nil, err
 		}
 	}
-
 	return &user, nil
+}
+
+// The Delete() method deletes a user. Their tokens, API keys and permissions are
+// deleted along with them by the database.
+func (m UserModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+	DELETE FROM users
+	WHERE id = $1`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
 
+// A UserSearch holds the filters for listing users. Email and Name match anywhere in the
+// address or name, ignoring case, and Activated is nil to include users whether or not
+// they are activated.
+type UserSearch struct {
+	Email     string
+	Name      string
+	Activated *bool
+}
+
+// The UserSortSafelist holds the sort keys accepted when listing users.
+var UserSortSafelist = SortSafelist("id", "name", "email", "created_at")
+
+// The GetAll() method returns a page of the users matching the search, for
+// administrators.
+func (m UserModel) GetAll(search UserSearch, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+	SELECT count(*) OVER(), id, created_at, name, email, password_hash, activated, version, deactivated_at
+	FROM users
+	WHERE (strpos(lower(email), lower($1)) > 0 OR $1 = '')
+	AND (strpos(lower(name), lower($2)) > 0 OR $2 = '')
+	AND (activated = $3 OR $3 IS NULL)
+	ORDER BY %s
+	LIMIT $4 OFFSET $5`, filters.orderBy())
+	args := []any{search.Email, search.Name, search.Activated, filters.limit(), filters.offset()}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+	totalRecords := 0
+	users := []*User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Version,
+			&user.DeactivatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+	return users, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// The SetDeactivated() method deactivates a user's account, or reactivates it. Only
+// deactivated_at changes, so a user whose email address was never verified is still
+// not activated once they are reactivated. It returns ErrRecordNotFound if there is no
+// such user, or if reactivating a user who isn't deactivated.
+func (m UserModel) SetDeactivated(id int64, deactivated bool) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+	query := `
+	UPDATE users
+	SET deactivated_at = CASE WHEN $2 THEN COALESCE(deactivated_at, NOW()) END,
+		version = version + 1
+	WHERE id = $1 AND ($2 OR deactivated_at IS NOT NULL)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, id, deactivated)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
 }
@@ -0,0 +1,140 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// The jsonEqual() function reports whether two JSON documents hold the same value,
+// regardless of formatting and member order.
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var x, y any
+	if err := json.Unmarshal(a, &x); err != nil {
+		t.Fatalf("invalid JSON %s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &y); err != nil {
+		t.Fatalf("invalid JSON %s: %v", b, err)
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// The examples from RFC 6902 Appendix A, followed by a few more cases. A want of ""
+// means the patch must fail with err.
+var applyTests = []struct {
+	name  string
+	doc   string
+	patch string
+	want  string
+	err   error
+}{
+	{"A.1 adding an object member", `{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": "qux"}]`, `{"baz": "qux", "foo": "bar"}`, nil},
+	{"A.2 adding an array element", `{"foo": ["bar", "baz"]}`, `[{"op": "add", "path": "/foo/1", "value": "qux"}]`, `{"foo": ["bar", "qux", "baz"]}`, nil},
+	{"A.3 removing an object member", `{"baz": "qux", "foo": "bar"}`, `[{"op": "remove", "path": "/baz"}]`, `{"foo": "bar"}`, nil},
+	{"A.4 removing an array element", `{"foo": ["bar", "qux", "baz"]}`, `[{"op": "remove", "path": "/foo/1"}]`, `{"foo": ["bar", "baz"]}`, nil},
+	{"A.5 replacing a value", `{"baz": "qux", "foo": "bar"}`, `[{"op": "replace", "path": "/baz", "value": "boo"}]`, `{"baz": "boo", "foo": "bar"}`, nil},
+	{"A.6 moving a value",
+		`{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`,
+		`[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+		`{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`, nil},
+	{"A.7 moving an array element", `{"foo": ["all", "grass", "cows", "eat"]}`, `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`, `{"foo": ["all", "cows", "eat", "grass"]}`, nil},
+	{"A.8 testing a value: success",
+		`{"baz": "qux", "foo": ["a", 2, "c"]}`,
+		`[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2}]`,
+		`{"baz": "qux", "foo": ["a", 2, "c"]}`, nil},
+	{"A.9 testing a value: error", `{"baz": "qux"}`, `[{"op": "test", "path": "/baz", "value": "bar"}]`, "", ErrTestFailed},
+	{"A.10 adding a nested member object", `{"foo": "bar"}`, `[{"op": "add", "path": "/child", "value": {"grandchild": {}}}]`, `{"foo": "bar", "child": {"grandchild": {}}}`, nil},
+	{"A.11 ignoring unrecognized elements", `{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": "qux", "xyz": 123}]`, `{"foo": "bar", "baz": "qux"}`, nil},
+	{"A.12 adding to a nonexistent target", `{"foo": "bar"}`, `[{"op": "add", "path": "/baz/bat", "value": "qux"}]`, "", ErrPathNotFound},
+	{"A.14 ~ escape ordering", `{"/": 9, "~1": 10}`, `[{"op": "test", "path": "/~01", "value": 10}]`, `{"/": 9, "~1": 10}`, nil},
+	{"A.15 comparing strings and numbers", `{"/": 9, "~1": 10}`, `[{"op": "test", "path": "/~01", "value": "10"}]`, "", ErrTestFailed},
+	{"A.16 adding an array value", `{"foo": ["bar"]}`, `[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`, `{"foo": ["bar", ["abc", "def"]]}`, nil},
+
+	{"~1 escape", `{"a/b": 1}`, `[{"op": "replace", "path": "/a~1b", "value": 2}]`, `{"a/b": 2}`, nil},
+	{"~0 escape", `{"m~n": 1}`, `[{"op": "remove", "path": "/m~0n"}]`, `{}`, nil},
+	{"append with -", `{"foo": [1, 2]}`, `[{"op": "add", "path": "/foo/-", "value": 3}]`, `{"foo": [1, 2, 3]}`, nil},
+	{"add at the end index", `{"foo": [1, 2]}`, `[{"op": "add", "path": "/foo/2", "value": 3}]`, `{"foo": [1, 2, 3]}`, nil},
+	{"add past the end", `{"foo": [1, 2]}`, `[{"op": "add", "path": "/foo/3", "value": 3}]`, "", ErrPathNotFound},
+	{"remove with -", `{"foo": [1, 2]}`, `[{"op": "remove", "path": "/foo/-"}]`, "", ErrPathNotFound},
+	{"leading zero index", `{"foo": [1, 2]}`, `[{"op": "remove", "path": "/foo/01"}]`, "", ErrPathNotFound},
+	{"replace the whole document", `{"foo": 1}`, `[{"op": "replace", "path": "", "value": [1]}]`, `[1]`, nil},
+	{"replace a missing member", `{"foo": 1}`, `[{"op": "replace", "path": "/bar", "value": 2}]`, "", ErrPathNotFound},
+	{"remove a missing member", `{"foo": 1}`, `[{"op": "remove", "path": "/bar"}]`, "", ErrPathNotFound},
+	{"copy", `{"foo": {"a": 1}}`, `[{"op": "copy", "from": "/foo", "path": "/bar"}, {"op": "replace", "path": "/bar/a", "value": 2}]`, `{"foo": {"a": 1}, "bar": {"a": 2}}`, nil},
+	{"move into a child", `{"foo": {"a": 1}}`, `[{"op": "move", "from": "/foo", "path": "/foo/b"}]`, "", ErrInvalidPatch},
+	{"test numbers numerically", `{"foo": 1.0}`, `[{"op": "test", "path": "/foo", "value": 1}]`, `{"foo": 1.0}`, nil},
+	{"test objects regardless of order", `{"foo": {"a": 1, "b": 2}}`, `[{"op": "test", "path": "/foo", "value": {"b": 2, "a": 1}}]`, `{"foo": {"a": 1, "b": 2}}`, nil},
+	{"test null", `{"foo": null}`, `[{"op": "test", "path": "/foo", "value": null}]`, `{"foo": null}`, nil},
+	{"failed operation undoes the earlier ones", `{"foo": 1}`, `[{"op": "add", "path": "/bar", "value": 2}, {"op": "test", "path": "/foo", "value": 2}]`, "", ErrTestFailed},
+	{"unknown op", `{}`, `[{"op": "frobnicate", "path": "/foo"}]`, "", ErrInvalidPatch},
+	{"missing path", `{}`, `[{"op": "add", "value": 1}]`, "", ErrInvalidPatch},
+	{"missing value", `{}`, `[{"op": "add", "path": "/foo"}]`, "", ErrInvalidPatch},
+	{"missing from", `{"foo": 1}`, `[{"op": "move", "path": "/bar"}]`, "", ErrInvalidPatch},
+	{"pointer without a leading slash", `{"foo": 1}`, `[{"op": "remove", "path": "foo"}]`, "", ErrInvalidPatch},
+	{"patch isn't an array", `{}`, `{"op": "add", "path": "/foo", "value": 1}`, "", ErrInvalidPatch},
+}
+
+func TestApply(t *testing.T) {
+	for _, tt := range applyTests {
+		got, err := Apply([]byte(tt.doc), []byte(tt.patch))
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%s: Apply() error = %v, want %v", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Apply() error = %v", tt.name, err)
+			continue
+		}
+		if !jsonEqual(t, got, []byte(tt.want)) {
+			t.Errorf("%s: Apply() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	// The examples from RFC 7396 Appendix A, and the example from section 3.
+	tests := []struct {
+		doc   string
+		patch string
+		want  string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		{
+			`{"title":"Goodbye!","author":{"givenName":"John","familyName":"Doe"},"tags":["example","sample"],"content":"This will be unchanged"}`,
+			`{"title":"Hello!","phoneNumber":"+01-123-456-7890","author":{"familyName":null},"tags":["example"]}`,
+			`{"title":"Hello!","author":{"givenName":"John"},"tags":["example"],"content":"This will be unchanged","phoneNumber":"+01-123-456-7890"}`,
+		},
+	}
+	for _, tt := range tests {
+		got, err := MergePatch([]byte(tt.doc), []byte(tt.patch))
+		if err != nil {
+			t.Errorf("MergePatch(%s, %s) error = %v", tt.doc, tt.patch, err)
+			continue
+		}
+		if !jsonEqual(t, got, []byte(tt.want)) {
+			t.Errorf("MergePatch(%s, %s) = %s, want %s", tt.doc, tt.patch, got, tt.want)
+		}
+	}
+
+	if _, err := MergePatch([]byte(`{}`), []byte(`{"a":`)); !errors.Is(err, ErrInvalidPatch) {
+		t.Errorf("MergePatch() with a malformed patch: error = %v, want %v", err, ErrInvalidPatch)
+	}
+}
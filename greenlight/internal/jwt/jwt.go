@@ -0,0 +1,212 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The signing algorithms supported by this package: HMAC with SHA-256, using a shared
+// secret, and Ed25519 signatures.
+const (
+	HS256 = "HS256"
+	EdDSA = "EdDSA"
+)
+
+// Define the errors returned when a token can't be verified. ErrInvalidToken covers
+// malformed tokens, unknown keys and bad signatures, while ErrExpiredToken means the
+// token was valid but its expiry time has passed.
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token has expired")
+)
+
+// A Key is a single signing key, identified by the ID sent in the "kid" header of the
+// tokens it signs. For HS256 keys the secret is shared between signing and verifying;
+// for EdDSA keys the secret is the 32-byte private key seed.
+type Key struct {
+	ID         string
+	Algorithm  string
+	secret     []byte
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+// NewKey returns a key with the given ID, algorithm and secret. HS256 secrets must be at
+// least 32 bytes long, and EdDSA secrets must be exactly ed25519.SeedSize bytes.
+func NewKey(id, algorithm string, secret []byte) (*Key, error) {
+	if id == "" {
+		return nil, errors.New("key id must be provided")
+	}
+	key := &Key{ID: id, Algorithm: algorithm}
+	switch algorithm {
+	case HS256:
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("key %q: HS256 secret must be at least 32 bytes long", id)
+		}
+		key.secret = secret
+	case EdDSA:
+		if len(secret) != ed25519.SeedSize {
+			return nil, fmt.Errorf("key %q: EdDSA secret must be %d bytes long", id, ed25519.SeedSize)
+		}
+		key.privateKey = ed25519.NewKeyFromSeed(secret)
+		key.publicKey = key.privateKey.Public().(ed25519.PublicKey)
+	default:
+		return nil, fmt.Errorf("key %q: unsupported algorithm %q", id, algorithm)
+	}
+	return key, nil
+}
+
+func (k *Key) sign(input []byte) []byte {
+	if k.Algorithm == EdDSA {
+		return ed25519.Sign(k.privateKey, input)
+	}
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write(input)
+	return mac.Sum(nil)
+}
+
+func (k *Key) verify(input, signature []byte) bool {
+	if k.Algorithm == EdDSA {
+		return ed25519.Verify(k.publicKey, input, signature)
+	}
+	return hmac.Equal(k.sign(input), signature)
+}
+
+// A KeySet holds every key which tokens may currently be signed with, and the one new
+// tokens are signed with. Keys are rotated by adding a new key and making it the signing
+// key, then removing the old key once the last tokens signed with it have expired.
+type KeySet struct {
+	signing *Key
+	keys    map[string]*Key
+}
+
+// NewKeySet returns a KeySet holding the given keys, which signs new tokens with the key
+// whose ID is signingID.
+func NewKeySet(keys []*Key, signingID string) (*KeySet, error) {
+	ks := &KeySet{keys: make(map[string]*Key, len(keys))}
+	for _, key := range keys {
+		if _, exists := ks.keys[key.ID]; exists {
+			return nil, fmt.Errorf("duplicate key id %q", key.ID)
+		}
+		ks.keys[key.ID] = key
+	}
+	ks.signing = ks.keys[signingID]
+	if ks.signing == nil {
+		return nil, fmt.Errorf("signing key %q not found", signingID)
+	}
+	return ks, nil
+}
+
+// ParseKeySet builds a KeySet from a comma-separated list of keys in the form
+// "id:algorithm:secret", where the secret is base64 encoded. If signingID is empty the
+// first key in the list is used to sign new tokens.
+func ParseKeySet(spec, signingID string) (*KeySet, error) {
+	var keys []*Key
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("key %q must be in the form id:algorithm:secret", entry)
+		}
+		secret, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("key %q: secret must be base64 encoded", parts[0])
+		}
+		key, err := NewKey(parts[0], parts[1], secret)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("at least one key must be provided")
+	}
+	if signingID == "" {
+		signingID = keys[0].ID
+	}
+	return NewKeySet(keys, signingID)
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// Sign encodes claims as the payload of a token signed with the signing key. The claims
+// should include an "exp" member, since Verify rejects tokens without one.
+func (ks *KeySet) Sign(claims any) (string, error) {
+	h, err := json.Marshal(header{Algorithm: ks.signing.Algorithm, Type: "JWT", KeyID: ks.signing.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ks.signing.sign([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks the signature of a token against the key named in its "kid" header,
+// checks its "exp" and "nbf" claims, and then decodes its payload into claims. The
+// algorithm in the header must match the key's own, so a token can't choose how it
+// is verified.
+func (ks *KeySet) Verify(token string, claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return ErrInvalidToken
+	}
+	key := ks.keys[h.KeyID]
+	if key == nil || key.Algorithm != h.Algorithm {
+		return ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return ErrInvalidToken
+	}
+
+	var registered struct {
+		Expiry    int64 `json:"exp"`
+		NotBefore int64 `json:"nbf"`
+	}
+	if err := decodeSegment(parts[1], &registered); err != nil {
+		return ErrInvalidToken
+	}
+	now := time.Now().Unix()
+	switch {
+	case registered.Expiry == 0 || registered.NotBefore > now:
+		return ErrInvalidToken
+	case registered.Expiry <= now:
+		return ErrExpiredToken
+	}
+
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+func decodeSegment(segment string, dst any) error {
+	js, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(js, dst)
+}
@@ -0,0 +1,191 @@
+package jwt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testClaims struct {
+	Subject   string `json:"sub"`
+	Expiry    int64  `json:"exp,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+}
+
+func newTestKey(t *testing.T, id, algorithm string, fill byte) *Key {
+	t.Helper()
+	key, err := NewKey(id, algorithm, bytes.Repeat([]byte{fill}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newTestKeySet(t *testing.T, signingID string, keys ...*Key) *KeySet {
+	t.Helper()
+	ks, err := NewKeySet(keys, signingID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+// The forge() function builds a token with the given header, signed with key, so that
+// tests can make tokens which Sign() never would.
+func forge(t *testing.T, key *Key, h header, claims any) string {
+	t.Helper()
+	hj, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(hj) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return input + "." + base64.RawURLEncoding.EncodeToString(key.sign([]byte(input)))
+}
+
+func TestVerify(t *testing.T) {
+	hs := newTestKey(t, "hs", HS256, 1)
+	ed := newTestKey(t, "ed", EdDSA, 2)
+	otherHS := newTestKey(t, "hs", HS256, 3)
+	ks := newTestKeySet(t, "hs", hs, ed)
+	edSigner := newTestKeySet(t, "ed", hs, ed)
+
+	now := time.Now()
+	valid := testClaims{Subject: "1", Expiry: now.Add(time.Hour).Unix()}
+	sign := func(ks *KeySet, claims testClaims) string {
+		token, err := ks.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	validHS := sign(ks, valid)
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"valid HS256", validHS, nil},
+		{"valid EdDSA", sign(edSigner, valid), nil},
+		{"valid with nbf in the past", sign(ks, testClaims{Subject: "1", Expiry: valid.Expiry, NotBefore: now.Add(-time.Minute).Unix()}), nil},
+		{"bad signature", flipSignature(t, validHS), ErrInvalidToken},
+		{"signed with another secret", forge(t, otherHS, header{Algorithm: HS256, Type: "JWT", KeyID: "hs"}, valid), ErrInvalidToken},
+		{"tampered payload", forgePayload(t, validHS, testClaims{Subject: "2", Expiry: valid.Expiry}), ErrInvalidToken},
+		{"unknown kid", forge(t, hs, header{Algorithm: HS256, Type: "JWT", KeyID: "missing"}, valid), ErrInvalidToken},
+		{"missing kid", forge(t, hs, header{Algorithm: HS256, Type: "JWT"}, valid), ErrInvalidToken},
+		{"alg doesn't match kid", forge(t, hs, header{Algorithm: HS256, Type: "JWT", KeyID: "ed"}, valid), ErrInvalidToken},
+		{"alg none", strings.Join(strings.Split(forge(t, hs, header{Algorithm: "none", Type: "JWT", KeyID: "hs"}, valid), ".")[:2], ".") + ".", ErrInvalidToken},
+		{"expired", sign(ks, testClaims{Subject: "1", Expiry: now.Add(-time.Second).Unix()}), ErrExpiredToken},
+		{"not yet valid", sign(ks, testClaims{Subject: "1", Expiry: valid.Expiry, NotBefore: now.Add(time.Hour).Unix()}), ErrInvalidToken},
+		{"missing exp", sign(ks, testClaims{Subject: "1"}), ErrInvalidToken},
+		{"too few segments", "a.b", ErrInvalidToken},
+		{"malformed header", "!!!." + strings.SplitN(validHS, ".", 2)[1], ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		var claims testClaims
+		err := ks.Verify(tt.token, &claims)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: Verify() = %v, want %v", tt.name, err, tt.want)
+			continue
+		}
+		if err == nil && claims.Subject != "1" {
+			t.Errorf("%s: sub = %q, want %q", tt.name, claims.Subject, "1")
+		}
+	}
+}
+
+// The forgePayload() function swaps the payload of token for claims, keeping the
+// original signature.
+func forgePayload(t *testing.T, token string, claims any) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+	return strings.Join(parts, ".")
+}
+
+// The flipSignature() function changes one bit of the signature of token.
+func flipSignature(t *testing.T, token string) string {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature[0] ^= 1
+	parts[2] = base64.RawURLEncoding.EncodeToString(signature)
+	return strings.Join(parts, ".")
+}
+
+func TestVerifyAfterRotation(t *testing.T) {
+	oldKey := newTestKey(t, "old", HS256, 1)
+	newKey := newTestKey(t, "new", EdDSA, 2)
+	claims := testClaims{Subject: "1", Expiry: time.Now().Add(time.Hour).Unix()}
+
+	before := newTestKeySet(t, "old", oldKey)
+	oldToken, err := before.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Add the new key and make it the signing key, keeping the old one for verifying.
+	during := newTestKeySet(t, "new", oldKey, newKey)
+	newToken, err := during.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, token := range map[string]string{"old token": oldToken, "new token": newToken} {
+		if err := during.Verify(token, &testClaims{}); err != nil {
+			t.Errorf("during rotation, %s: Verify() = %v, want nil", name, err)
+		}
+	}
+	if err := before.Verify(newToken, &testClaims{}); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("new token with only the old key: Verify() = %v, want %v", err, ErrInvalidToken)
+	}
+
+	// Once the old key is removed, tokens signed with it stop working.
+	after := newTestKeySet(t, "new", newKey)
+	if err := after.Verify(oldToken, &testClaims{}); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("after rotation, old token: Verify() = %v, want %v", err, ErrInvalidToken)
+	}
+	if err := after.Verify(newToken, &testClaims{}); err != nil {
+		t.Errorf("after rotation, new token: Verify() = %v, want nil", err)
+	}
+}
+
+func TestParseKeySet(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	tests := []struct {
+		name      string
+		spec      string
+		signingID string
+		ok        bool
+	}{
+		{"single key", "a:HS256:" + secret, "", true},
+		{"choose signing key", "a:HS256:" + secret + ",b:EdDSA:" + secret, "b", true},
+		{"unknown signing key", "a:HS256:" + secret, "b", false},
+		{"duplicate id", "a:HS256:" + secret + ",a:EdDSA:" + secret, "", false},
+		{"short HS256 secret", "a:HS256:" + base64.StdEncoding.EncodeToString([]byte("short")), "", false},
+		{"unsupported algorithm", "a:RS256:" + secret, "", false},
+		{"secret not base64", "a:HS256:***", "", false},
+		{"missing secret", "a:HS256", "", false},
+		{"empty", "", "", false},
+	}
+	for _, tt := range tests {
+		_, err := ParseKeySet(tt.spec, tt.signingID)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: ParseKeySet() error = %v, want ok = %v", tt.name, err, tt.ok)
+		}
+	}
+}
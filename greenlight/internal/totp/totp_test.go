@@ -0,0 +1,100 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// The ASCII secret "12345678901234567890" used by the RFC 4226 and RFC 6238 test
+// vectors, base32 encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestHOTP(t *testing.T) {
+	// RFC 4226 Appendix D.
+	want := []string{"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489"}
+	key, err := decodeSecret(rfcSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for counter, code := range want {
+		if got := hotp(key, int64(counter)); got != code {
+			t.Errorf("hotp(%d) = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+// The SHA-1 test vectors from RFC 6238 Appendix B. The RFC gives eight digit codes, and
+// six digit codes are their last six digits.
+var rfc6238Tests = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestCode(t *testing.T) {
+	for _, tt := range rfc6238Tests {
+		got, err := Code(rfcSecret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.code {
+			t.Errorf("Code at %d = %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tt := range rfc6238Tests {
+		now := time.Unix(tt.unix, 0)
+		step, ok := Validate(rfcSecret, tt.code, now, 0)
+		if !ok || step != Step(now) {
+			t.Errorf("Validate at %d = (%d, %v), want (%d, true)", tt.unix, step, ok, Step(now))
+		}
+	}
+
+	now := time.Unix(1111111111, 0)
+	tests := []struct {
+		name   string
+		offset time.Duration
+		skew   int
+		ok     bool
+	}{
+		{"previous step within skew", -Period * time.Second, 1, true},
+		{"next step within skew", Period * time.Second, 1, true},
+		{"previous step without skew", -Period * time.Second, 0, false},
+		{"two steps back with skew 1", -2 * Period * time.Second, 1, false},
+		{"two steps ahead with skew 1", 2 * Period * time.Second, 1, false},
+		{"two steps back with skew 2", -2 * Period * time.Second, 2, true},
+	}
+	for _, tt := range tests {
+		codeTime := now.Add(tt.offset)
+		code, err := Code(rfcSecret, codeTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		step, ok := Validate(rfcSecret, code, now, tt.skew)
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if ok && step != Step(codeTime) {
+			t.Errorf("%s: step = %d, want %d", tt.name, step, Step(codeTime))
+		}
+	}
+
+	for _, code := range []string{"", "05047", "0504711", "abcdef", "050472"} {
+		if _, ok := Validate(rfcSecret, code, now, 1); ok {
+			t.Errorf("Validate(%q) = true, want false", code)
+		}
+	}
+	if _, ok := Validate("not base32!", "050471", now, 1); ok {
+		t.Error("Validate with an invalid secret = true, want false")
+	}
+}
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS permissions (
+id bigserial PRIMARY KEY,
+code text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS users_permissions (
+user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+PRIMARY KEY (user_id, permission_id)
+);
+
+-- Add the two permissions used by the API, unless they already exist.
+INSERT INTO permissions (code)
+SELECT code FROM (VALUES ('movies:read'), ('movies:write')) AS p(code)
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE permissions.code = p.code);
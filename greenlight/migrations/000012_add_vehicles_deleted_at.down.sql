@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'vehicles:purge';
+ALTER TABLE cars DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE motorbikes DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,8 @@
+-- deleted_at is NULL for live records and set when a record is moved to the trash.
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+ALTER TABLE motorbikes ADD COLUMN IF NOT EXISTS deleted_at timestamp(0) with time zone;
+
+-- Permission for permanently purging records from the trash, for admins only.
+INSERT INTO permissions (code)
+SELECT 'vehicles:purge'
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE code = 'vehicles:purge');
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS vehicle_history;
+DROP FUNCTION IF EXISTS vehicle_history_append_only();
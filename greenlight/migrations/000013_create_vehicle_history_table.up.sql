@@ -0,0 +1,41 @@
+-- Append-only log of every change made to a car or motorbike. old_values and new_values
+-- hold only the columns which changed, except for inserts and snapshots, whose
+-- new_values hold the whole row. There is no foreign key on vehicle_id, so the history
+-- of a purged record is kept.
+CREATE TABLE IF NOT EXISTS vehicle_history (
+id bigserial PRIMARY KEY,
+vehicle_type text NOT NULL,
+vehicle_id bigint NOT NULL,
+version integer NOT NULL,
+action text NOT NULL,
+user_id bigint REFERENCES users ON DELETE SET NULL,
+changed_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+old_values jsonb,
+new_values jsonb
+);
+
+CREATE INDEX IF NOT EXISTS vehicle_history_vehicle_idx ON vehicle_history (vehicle_type, vehicle_id, version);
+
+-- Reject any attempt to rewrite the history. The one exception is clearing user_id,
+-- which PostgreSQL does as an UPDATE of the row when the user is deleted, because of
+-- ON DELETE SET NULL.
+CREATE OR REPLACE FUNCTION vehicle_history_append_only() RETURNS trigger AS $$
+BEGIN
+IF TG_OP = 'UPDATE' AND NEW.user_id IS NULL
+AND (to_jsonb(NEW) - 'user_id') = (to_jsonb(OLD) - 'user_id') THEN
+RETURN NEW;
+END IF;
+RAISE EXCEPTION 'vehicle_history is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER vehicle_history_append_only
+BEFORE UPDATE OR DELETE ON vehicle_history
+FOR EACH ROW EXECUTE FUNCTION vehicle_history_append_only();
+
+-- Records which existed before the history was kept start with a snapshot of their
+-- current state, so they can be reconstructed from this version onwards.
+INSERT INTO vehicle_history (vehicle_type, vehicle_id, version, action, changed_at, new_values)
+SELECT 'cars', id, version, 'snapshot', NOW(), to_jsonb(cars) - 'version' FROM cars;
+INSERT INTO vehicle_history (vehicle_type, vehicle_id, version, action, changed_at, new_values)
+SELECT 'motorbikes', id, version, 'snapshot', NOW(), to_jsonb(motorbikes) - 'version' FROM motorbikes;
@@ -0,0 +1,8 @@
+-- Refresh tokens and the authentication tokens issued with them share a family id, so
+-- that a whole family can be revoked at once. A refresh token is marked as rotated once
+-- it has been exchanged for a new one, and kept until it expires so that any attempt to
+-- reuse it can be detected.
+CREATE SEQUENCE IF NOT EXISTS token_families;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family_id bigint;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS rotated_at timestamp(0) with time zone;
+CREATE INDEX IF NOT EXISTS tokens_family_id_idx ON tokens (family_id);
@@ -0,0 +1,15 @@
+-- API keys are long-lived credentials for scripts and other machine clients. Like
+-- tokens, only a hash of each key is stored. A key is limited to the permission codes it
+-- was created with, which must be a subset of its owner's.
+CREATE TABLE IF NOT EXISTS api_keys (
+id bigserial PRIMARY KEY,
+user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+name text NOT NULL,
+hash bytea NOT NULL UNIQUE,
+permissions text[] NOT NULL,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+expiry timestamp(0) with time zone,
+last_used_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_user_id_idx ON api_keys (user_id);
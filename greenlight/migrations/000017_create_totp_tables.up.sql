@@ -0,0 +1,21 @@
+-- A user's TOTP secret for two-factor authentication. The row is created when the user
+-- starts enrolling, and two-factor authentication is only enabled once confirmed_at is
+-- set. last_step holds the time step of the last code accepted, so that a code can't be
+-- used twice.
+CREATE TABLE IF NOT EXISTS user_totp (
+user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+secret text NOT NULL,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+confirmed_at timestamp(0) with time zone,
+last_step bigint NOT NULL DEFAULT 0
+);
+
+-- Single-use recovery codes, stored hashed, for when the user has lost their device.
+CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+id bigserial PRIMARY KEY,
+user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+hash bytea NOT NULL,
+used_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS totp_recovery_codes_user_id_idx ON totp_recovery_codes (user_id);
@@ -0,0 +1,17 @@
+-- Failed sign in attempts, counted separately for each account (by email address) and
+-- each client IP address. Once too many attempts have failed the account or IP address
+-- is locked out until locked_until.
+CREATE TABLE IF NOT EXISTS login_throttles (
+kind text NOT NULL,
+subject text NOT NULL,
+failures integer NOT NULL DEFAULT 0,
+last_failure_at timestamp with time zone NOT NULL DEFAULT NOW(),
+locked_until timestamp with time zone,
+PRIMARY KEY (kind, subject)
+);
+
+-- Add the permission for administering users, which is needed to see and clear
+-- lockouts, unless it already exists.
+INSERT INTO permissions (code)
+SELECT 'users:admin'
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE code = 'users:admin');
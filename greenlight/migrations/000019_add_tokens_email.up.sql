@@ -0,0 +1,3 @@
+-- Email change tokens are sent to the new address, which is kept with the token until
+-- the change is confirmed.
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS email text;
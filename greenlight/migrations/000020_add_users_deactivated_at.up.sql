@@ -0,0 +1,3 @@
+-- Record when an administrator deactivated a user, to tell a deactivated account apart
+-- from one which simply hasn't been activated yet.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deactivated_at timestamp(0) with time zone;
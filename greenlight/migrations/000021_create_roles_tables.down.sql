@@ -0,0 +1,5 @@
+DELETE FROM permissions WHERE code = 'permissions:admin';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role text NOT NULL DEFAULT '';
+DROP TABLE IF EXISTS users_roles;
+DROP TABLE IF EXISTS roles_permissions;
+DROP TABLE IF EXISTS roles;
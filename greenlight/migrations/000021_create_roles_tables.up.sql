@@ -0,0 +1,42 @@
+-- Roles bundle permission codes, so that a set of permissions can be granted to a user
+-- in one go. A user's permissions are those granted to them directly together with
+-- those of all of their roles.
+CREATE TABLE IF NOT EXISTS roles (
+id bigserial PRIMARY KEY,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+name text UNIQUE NOT NULL,
+description text NOT NULL DEFAULT '',
+version integer NOT NULL DEFAULT 1
+);
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+PRIMARY KEY (user_id, role_id)
+);
+
+-- The role column in the users table was never used, and since nothing sets it, it made
+-- inserting a user fail. Turn any values set by hand into roles before dropping it.
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'role') THEN
+		INSERT INTO roles (name)
+		SELECT DISTINCT role FROM users WHERE role <> ''
+		ON CONFLICT (name) DO NOTHING;
+		INSERT INTO users_roles (user_id, role_id)
+		SELECT users.id, roles.id FROM users INNER JOIN roles ON roles.name = users.role
+		ON CONFLICT DO NOTHING;
+		ALTER TABLE users DROP COLUMN role;
+	END IF;
+END $$;
+
+-- Add the permission for administering roles and permissions, unless it already exists.
+INSERT INTO permissions (code)
+SELECT 'permissions:admin'
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE code = 'permissions:admin');
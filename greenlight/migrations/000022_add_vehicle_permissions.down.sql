@@ -0,0 +1,36 @@
+INSERT INTO permissions (code)
+SELECT code FROM (VALUES ('movies:read'), ('movies:write')) AS p(code)
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE permissions.code = p.code);
+
+CREATE TEMPORARY TABLE movies_permissions_map (old_code text NOT NULL, new_code text NOT NULL);
+INSERT INTO movies_permissions_map VALUES
+	('movies:read', 'cars:read'), ('movies:read', 'motorbikes:read'), ('movies:read', 'cars:*'), ('movies:read', 'motorbikes:*'),
+	('movies:write', 'cars:write'), ('movies:write', 'motorbikes:write'), ('movies:write', 'cars:*'), ('movies:write', 'motorbikes:*');
+
+INSERT INTO users_permissions (user_id, permission_id)
+SELECT users_permissions.user_id, old_permissions.id
+FROM users_permissions
+INNER JOIN permissions AS new_permissions ON new_permissions.id = users_permissions.permission_id
+INNER JOIN movies_permissions_map ON movies_permissions_map.new_code = new_permissions.code
+INNER JOIN permissions AS old_permissions ON old_permissions.code = movies_permissions_map.old_code
+ON CONFLICT DO NOTHING;
+
+INSERT INTO roles_permissions (role_id, permission_id)
+SELECT roles_permissions.role_id, old_permissions.id
+FROM roles_permissions
+INNER JOIN permissions AS new_permissions ON new_permissions.id = roles_permissions.permission_id
+INNER JOIN movies_permissions_map ON movies_permissions_map.new_code = new_permissions.code
+INNER JOIN permissions AS old_permissions ON old_permissions.code = movies_permissions_map.old_code
+ON CONFLICT DO NOTHING;
+
+UPDATE api_keys
+SET permissions = ARRAY(
+	SELECT DISTINCT COALESCE(movies_permissions_map.old_code, code)
+	FROM unnest(api_keys.permissions) AS code
+	LEFT JOIN movies_permissions_map ON movies_permissions_map.new_code = code
+	WHERE code NOT LIKE 'cars:%' AND code NOT LIKE 'motorbikes:%' OR movies_permissions_map.old_code IS NOT NULL
+);
+
+DROP TABLE movies_permissions_map;
+
+DELETE FROM permissions WHERE code LIKE 'cars:%' OR code LIKE 'motorbikes:%';
@@ -0,0 +1,46 @@
+-- Replace the movies:read and movies:write permissions left over from the Greenlight
+-- application with separate permissions for cars and motorbikes. The wildcard codes grant
+-- every permission for their kind of vehicle.
+INSERT INTO permissions (code)
+SELECT code FROM (VALUES
+	('cars:read'), ('cars:write'), ('cars:delete'), ('cars:*'),
+	('motorbikes:read'), ('motorbikes:write'), ('motorbikes:delete'), ('motorbikes:*')
+) AS p(code)
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE permissions.code = p.code);
+
+-- Which new codes each old code maps onto. Holding movies:write used to allow deleting
+-- vehicles too, so it maps onto both the write and delete permissions.
+CREATE TEMPORARY TABLE movies_permissions_map (old_code text NOT NULL, new_code text NOT NULL);
+INSERT INTO movies_permissions_map VALUES
+	('movies:read', 'cars:read'), ('movies:read', 'motorbikes:read'),
+	('movies:write', 'cars:write'), ('movies:write', 'cars:delete'),
+	('movies:write', 'motorbikes:write'), ('movies:write', 'motorbikes:delete');
+
+INSERT INTO users_permissions (user_id, permission_id)
+SELECT users_permissions.user_id, new_permissions.id
+FROM users_permissions
+INNER JOIN permissions AS old_permissions ON old_permissions.id = users_permissions.permission_id
+INNER JOIN movies_permissions_map ON movies_permissions_map.old_code = old_permissions.code
+INNER JOIN permissions AS new_permissions ON new_permissions.code = movies_permissions_map.new_code
+ON CONFLICT DO NOTHING;
+
+INSERT INTO roles_permissions (role_id, permission_id)
+SELECT roles_permissions.role_id, new_permissions.id
+FROM roles_permissions
+INNER JOIN permissions AS old_permissions ON old_permissions.id = roles_permissions.permission_id
+INNER JOIN movies_permissions_map ON movies_permissions_map.old_code = old_permissions.code
+INNER JOIN permissions AS new_permissions ON new_permissions.code = movies_permissions_map.new_code
+ON CONFLICT DO NOTHING;
+
+UPDATE api_keys
+SET permissions = ARRAY(
+	SELECT DISTINCT COALESCE(movies_permissions_map.new_code, code)
+	FROM unnest(api_keys.permissions) AS code
+	LEFT JOIN movies_permissions_map ON movies_permissions_map.old_code = code
+)
+WHERE permissions && ARRAY['movies:read', 'movies:write'];
+
+DROP TABLE movies_permissions_map;
+
+-- Deleting the old codes removes them from users and roles too.
+DELETE FROM permissions WHERE code IN ('movies:read', 'movies:write');
@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code IN ('cars:write:any', 'cars:delete:any', 'motorbikes:write:any', 'motorbikes:delete:any');
+ALTER TABLE motorbikes DROP COLUMN IF EXISTS created_by;
+ALTER TABLE cars DROP COLUMN IF EXISTS created_by;
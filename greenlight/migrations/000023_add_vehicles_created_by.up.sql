@@ -0,0 +1,25 @@
+-- Record the user who created each car and motorbike. Only the owner, or a user holding
+-- the matching :any permission, may change or delete a record. Records whose owner has
+-- been deleted are left without one, so only :any holders can change them.
+ALTER TABLE cars ADD COLUMN IF NOT EXISTS created_by bigint REFERENCES users ON DELETE SET NULL;
+ALTER TABLE motorbikes ADD COLUMN IF NOT EXISTS created_by bigint REFERENCES users ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS cars_created_by_idx ON cars (created_by);
+CREATE INDEX IF NOT EXISTS motorbikes_created_by_idx ON motorbikes (created_by);
+
+-- Fill in the owners of existing records from the history, where it recorded who
+-- inserted them.
+UPDATE cars SET created_by = vehicle_history.user_id
+FROM vehicle_history
+WHERE vehicle_history.vehicle_type = 'cars' AND vehicle_history.vehicle_id = cars.id
+AND vehicle_history.action = 'insert';
+UPDATE motorbikes SET created_by = vehicle_history.user_id
+FROM vehicle_history
+WHERE vehicle_history.vehicle_type = 'motorbikes' AND vehicle_history.vehicle_id = motorbikes.id
+AND vehicle_history.action = 'insert';
+
+INSERT INTO permissions (code)
+SELECT code FROM (VALUES
+	('cars:write:any'), ('cars:delete:any'), ('motorbikes:write:any'), ('motorbikes:delete:any')
+) AS p(code)
+WHERE NOT EXISTS (SELECT 1 FROM permissions WHERE permissions.code = p.code);
@@ -0,0 +1,15 @@
+-- Records which existed before the vehicle history was kept have no recorded creator,
+-- so migration 000023 left them without an owner, and only holders of the :any
+-- permissions can change or delete them. Rather than handing those permissions to every
+-- existing writer, which would leave every record open to all of them, bundle them in a
+-- role which administrators give to the users who should look after such records.
+INSERT INTO roles (name, description)
+VALUES ('vehicle-admin', 'May change and delete any car or motorbike, including those without an owner')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO roles_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE roles.name = 'vehicle-admin'
+AND permissions.code IN ('cars:write:any', 'cars:delete:any', 'motorbikes:write:any', 'motorbikes:delete:any')
+ON CONFLICT DO NOTHING;